@@ -16,6 +16,8 @@ import (
 	"github.com/AndreaCasaluci/go-chat-app/db"
 	"github.com/AndreaCasaluci/go-chat-app/handlers"
 	"github.com/AndreaCasaluci/go-chat-app/middleware"
+	"github.com/AndreaCasaluci/go-chat-app/models"
+	"github.com/AndreaCasaluci/go-chat-app/ratelimit"
 	"github.com/gorilla/mux"
 )
 
@@ -27,6 +29,17 @@ func main() {
 		return
 	}
 
+	if _, err := utils.GetKeySet(); err != nil {
+		log.Fatalf("Could not load JWT signing keys: %v", err)
+		return
+	}
+
+	policies, err := ratelimit.GetRoutePolicies()
+	if err != nil {
+		log.Fatalf("Could not load rate limits: %v", err)
+		return
+	}
+
 	db, err := database.GetDb()
 	if err != nil {
 		log.Fatalf("Could not connect to the database: %v", err)
@@ -38,7 +51,7 @@ func main() {
 		port = "8080"
 	}
 
-	server := RunServer(port)
+	server := RunServer(port, policies)
 	GracefulShutdown(server, db, 10*time.Second)
 }
 
@@ -56,6 +69,9 @@ func GracefulShutdown(server *http.Server, db *sql.DB, timeout time.Duration) {
 		log.Fatalf("Server shutdown failed: %v", err)
 	}
 
+	log.Println("Closing WebSocket connections...")
+	handlers.GetHub().CloseAll()
+
 	if db != nil {
 		log.Println("Closing database connection...")
 		err := db.Close()
@@ -67,9 +83,14 @@ func GracefulShutdown(server *http.Server, db *sql.DB, timeout time.Duration) {
 	log.Println("Server gracefully stopped")
 }
 
-func RunServer(port string) *http.Server {
+func RunServer(port string, policies *ratelimit.RoutePolicies) *http.Server {
 	r := mux.NewRouter()
 
+	authLimit := middleware.RateLimit(policies.Auth)
+	writeLimit := middleware.RateLimit(policies.Write)
+	readLimit := middleware.RateLimit(policies.Read)
+	ipLimit := middleware.IPRateLimit(policies.IP)
+
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, err := fmt.Fprintf(w, "Service is running")
@@ -78,9 +99,59 @@ func RunServer(port string) *http.Server {
 		}
 	}).Methods("GET")
 
-	r.HandleFunc("/register", handlers.RegisterUser).Methods("POST")
-	r.HandleFunc("/login", handlers.LoginUser).Methods("POST")
-	r.HandleFunc("/users/{uuid}", middleware.JWTMiddleware(handlers.UpdateUser)).Methods("PATCH")
+	r.HandleFunc("/.well-known/jwks.json", handlers.GetJWKS).Methods("GET")
+
+	r.HandleFunc("/register", authLimit(handlers.RegisterUser)).Methods("POST")
+	r.HandleFunc("/login", authLimit(handlers.LoginUser)).Methods("POST")
+	r.HandleFunc("/login/mfa", authLimit(handlers.LoginMFA)).Methods("POST")
+	r.HandleFunc("/auth/oidc/login", authLimit(handlers.OIDCLogin)).Methods("GET")
+	r.HandleFunc("/auth/oidc/callback", authLimit(handlers.OIDCCallback)).Methods("GET")
+	r.HandleFunc("/auth/refresh", authLimit(handlers.RefreshToken)).Methods("POST")
+	r.HandleFunc("/logout", ipLimit(middleware.JWTMiddleware(writeLimit(handlers.Logout)))).Methods("POST")
+	r.HandleFunc("/password/forgot", authLimit(handlers.ForgotPassword)).Methods("POST")
+	r.HandleFunc("/password/reset", authLimit(handlers.ResetPassword)).Methods("POST")
+	r.HandleFunc("/verify-email", authLimit(handlers.VerifyEmail)).Methods("GET", "POST")
+	r.HandleFunc("/verify-email/resend", ipLimit(middleware.JWTMiddleware(authLimit(handlers.ResendVerificationEmail)))).Methods("POST")
+	r.HandleFunc("/users/me", ipLimit(middleware.JWTMiddleware(readLimit(handlers.GetCurrentUser), models.ScopeUsersRead))).Methods("GET")
+	r.HandleFunc("/users/me/blocks", ipLimit(middleware.JWTMiddleware(readLimit(handlers.ListBlockedUsers)))).Methods("GET")
+	r.HandleFunc("/users/search", ipLimit(middleware.JWTMiddleware(readLimit(handlers.SearchUsers), models.ScopeUsersRead))).Methods("GET")
+	r.HandleFunc("/users/batch", ipLimit(middleware.JWTMiddleware(readLimit(handlers.BatchGetUsers), models.ScopeUsersRead))).Methods("POST")
+	r.HandleFunc("/users/{uuid}", ipLimit(middleware.JWTMiddleware(readLimit(handlers.GetUser), models.ScopeUsersRead))).Methods("GET")
+	r.HandleFunc("/users/{uuid}", ipLimit(middleware.JWTMiddleware(writeLimit(handlers.UpdateUser)))).Methods("PATCH")
+	r.HandleFunc("/users/{uuid}/block", ipLimit(middleware.JWTMiddleware(writeLimit(handlers.BlockUser)))).Methods("POST")
+	r.HandleFunc("/users/{uuid}/block", ipLimit(middleware.JWTMiddleware(writeLimit(handlers.UnblockUser)))).Methods("DELETE")
+
+	r.HandleFunc("/mfa/totp/enroll", ipLimit(middleware.JWTMiddleware(writeLimit(handlers.EnrollTOTP)))).Methods("POST")
+	r.HandleFunc("/mfa/totp/confirm", ipLimit(middleware.JWTMiddleware(writeLimit(handlers.ConfirmTOTP)))).Methods("POST")
+	r.HandleFunc("/mfa/totp/disable", ipLimit(middleware.JWTMiddleware(writeLimit(handlers.DisableTOTP)))).Methods("POST")
+
+	r.HandleFunc("/tokens", ipLimit(middleware.JWTMiddleware(writeLimit(handlers.CreatePersonalAccessToken)))).Methods("POST")
+	r.HandleFunc("/tokens", ipLimit(middleware.JWTMiddleware(readLimit(handlers.ListPersonalAccessTokens)))).Methods("GET")
+	r.HandleFunc("/tokens/{uuid}", ipLimit(middleware.JWTMiddleware(writeLimit(handlers.RevokePersonalAccessToken)))).Methods("DELETE")
+
+	r.HandleFunc("/sessions", ipLimit(middleware.JWTMiddleware(readLimit(handlers.ListSessions)))).Methods("GET")
+	r.HandleFunc("/sessions/revoke-others", ipLimit(middleware.JWTMiddleware(writeLimit(handlers.RevokeOtherSessions)))).Methods("POST")
+	r.HandleFunc("/sessions/{uuid}", ipLimit(middleware.JWTMiddleware(writeLimit(handlers.RevokeSession)))).Methods("DELETE")
+
+	r.HandleFunc("/conversations/{peer_uuid}/messages", ipLimit(middleware.JWTMiddleware(readLimit(handlers.GetConversationMessages), models.ScopeMessagesRead))).Methods("GET")
+
+	r.HandleFunc("/groups", ipLimit(middleware.JWTMiddleware(writeLimit(handlers.CreateGroup), models.ScopeGroupsWrite))).Methods("POST")
+	r.HandleFunc("/groups", ipLimit(middleware.JWTMiddleware(readLimit(handlers.ListGroups), models.ScopeGroupsRead))).Methods("GET")
+	r.HandleFunc("/groups/{uuid}", ipLimit(middleware.JWTMiddleware(readLimit(handlers.GetGroup), models.ScopeGroupsRead))).Methods("GET")
+	r.HandleFunc("/groups/{uuid}", ipLimit(middleware.JWTMiddleware(writeLimit(handlers.UpdateGroup), models.ScopeGroupsWrite))).Methods("PATCH")
+	r.HandleFunc("/groups/{uuid}", ipLimit(middleware.JWTMiddleware(writeLimit(handlers.DeleteGroup), models.ScopeGroupsWrite))).Methods("DELETE")
+	r.HandleFunc("/groups/{uuid}/members", ipLimit(middleware.JWTMiddleware(readLimit(handlers.ListGroupMembers), models.ScopeGroupsRead))).Methods("GET")
+	r.HandleFunc("/groups/{uuid}/members", ipLimit(middleware.JWTMiddleware(writeLimit(handlers.AddGroupMember), models.ScopeGroupsWrite))).Methods("POST")
+	r.HandleFunc("/groups/{uuid}/members/{user_uuid}", ipLimit(middleware.JWTMiddleware(writeLimit(handlers.UpdateGroupMember), models.ScopeGroupsWrite))).Methods("PATCH")
+	r.HandleFunc("/groups/{uuid}/members/{user_uuid}", ipLimit(middleware.JWTMiddleware(writeLimit(handlers.RemoveGroupMember), models.ScopeGroupsWrite))).Methods("DELETE")
+	r.HandleFunc("/groups/{uuid}/owner", ipLimit(middleware.JWTMiddleware(writeLimit(handlers.TransferGroupOwnership), models.ScopeGroupsWrite))).Methods("PUT")
+	r.HandleFunc("/groups/{uuid}/leave", ipLimit(middleware.JWTMiddleware(writeLimit(handlers.LeaveGroup), models.ScopeGroupsWrite))).Methods("POST")
+	r.HandleFunc("/groups/{uuid}/messages", ipLimit(middleware.JWTMiddleware(readLimit(handlers.GetGroupMessages), models.ScopeMessagesRead))).Methods("GET")
+
+	r.HandleFunc("/media", ipLimit(middleware.JWTMiddleware(writeLimit(handlers.UploadMedia), models.ScopeMessagesWrite))).Methods("POST")
+	r.HandleFunc("/messages/{uuid}/media", ipLimit(middleware.JWTMiddleware(readLimit(handlers.GetMessageMedia), models.ScopeMessagesRead))).Methods("GET")
+
+	r.HandleFunc("/ws", ipLimit(middleware.WebSocketJWTMiddleware(readLimit(handlers.HandleWebSocket)))).Methods("GET")
 
 	server := &http.Server{
 		Addr:    ":" + port,
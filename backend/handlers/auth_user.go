@@ -1,16 +1,34 @@
 package handlers
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/AndreaCasaluci/go-chat-app/models"
+	"github.com/AndreaCasaluci/go-chat-app/ratelimit"
 	"github.com/AndreaCasaluci/go-chat-app/utils"
 	"github.com/google/uuid"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/AndreaCasaluci/go-chat-app/db"
 	"github.com/AndreaCasaluci/go-chat-app/repository"
-	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+
+	// Longest User-Agent recorded for a session.
+	maxUserAgentLength = 512
+
+	// How recently the caller must have logged in to perform a sensitive
+	// operation without supplying their current password.
+	recentAuthWindow = 5 * time.Minute
 )
 
 type LoginRequest struct {
@@ -19,7 +37,23 @@ type LoginRequest struct {
 }
 
 type LoginResponse struct {
-	Token string `json:"token"`
+	Token            string    `json:"token"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+// MFARequiredResponse is returned by LoginUser instead of tokens when the
+// user has two-factor authentication enabled. MFAToken is exchanged for the
+// real tokens at POST /login/mfa together with a code.
+type MFARequiredResponse struct {
+	MFARequired bool      `json:"mfa_required"`
+	MFAToken    string    `json:"mfa_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
 }
 
 func LoginUser(w http.ResponseWriter, r *http.Request) {
@@ -42,41 +76,319 @@ func LoginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	limiter, err := ratelimit.GetLoginLimiter()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not get login limiter: %v", err), http.StatusInternalServerError)
+		return
+	}
+
 	ctx := r.Context()
+	accountKey := accountLoginKey(loginReq.Email)
+	ipKey := ipLoginKey(utils.ClientIP(r))
+
+	retryAfter, err := reserveLoginAttempt(ctx, limiter, accountKey, ipKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking login attempts: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if retryAfter > 0 {
+		writeLoginLocked(w, retryAfter)
+		return
+	}
 
 	user, err := repository.AuthenticateUser(ctx, db, loginReq.Email, loginReq.Password)
 	if err != nil {
+		if !errors.Is(err, repository.ErrInvalidCredentials) {
+			releaseLoginAttempt(ctx, limiter, accountKey, ipKey)
+		}
 		http.Error(w, fmt.Sprintf("Authentication failed: %v", err), http.StatusUnauthorized)
 		return
 	}
 
-	token, err := generateJWT(user.ID, user.UUID, user.Username, user.Email)
+	// Only the account is reset: a client holding one valid password must
+	// not be able to clear the failures of its address.
+	resetLoginFailures(ctx, limiter, accountKey)
+	releaseLoginAttempt(ctx, limiter, ipKey)
+
+	if user.TOTPEnabled {
+		writeMFARequired(w, user)
+		return
+	}
+
+	response, err := issueTokens(r, db, user)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error generating tokens: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// writeMFARequired answers a login whose first factor succeeded for a user
+// with two-factor authentication enabled, handing out the token to present
+// along with the second factor to LoginMFA.
+func writeMFARequired(w http.ResponseWriter, user *models.User) {
+	mfaToken, expiresAt, err := utils.GenerateMFAPendingToken(user.UUID, mfaPendingTTL)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error generating MFA token: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MFARequiredResponse{MFARequired: true, MFAToken: mfaToken, ExpiresAt: expiresAt})
+}
+
+// RefreshToken exchanges a refresh token for a new access token and a new
+// refresh token. Each refresh token works once; replaying an old one revokes
+// every token descended from the same login.
+func RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var refreshReq RefreshRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&refreshReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.ValidateStruct(refreshReq); err != nil {
+		http.Error(w, fmt.Sprintf("Validation error: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+
+	newRefreshToken, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error generating refresh token: %v", err), http.StatusInternalServerError)
+		return
+	}
+	refreshExpiresAt := time.Now().Add(refreshTokenTTL())
+
+	rotated, err := repository.RotateRefreshToken(ctx, db, repository.RotateRefreshTokenParams{
+		OldTokenHash: utils.HashToken(refreshReq.RefreshToken),
+		NewTokenHash: utils.HashToken(newRefreshToken),
+		ExpiresAt:    refreshExpiresAt,
+		IPAddress:    utils.ClientIP(r),
+	})
+	if err != nil {
+		if errors.Is(err, repository.ErrRefreshTokenReused) && rotated != nil {
+			// The session was revoked in the database; its access tokens and
+			// sockets must go too.
+			if err := invalidateSessionTokens(ctx, db, rotated.FamilyID); err != nil {
+				log.Printf("Error invalidating reused session %s: %v", rotated.FamilyID, err)
+			}
+		}
+		if errors.Is(err, repository.ErrRefreshTokenInvalid) || errors.Is(err, repository.ErrRefreshTokenExpired) || errors.Is(err, repository.ErrRefreshTokenReused) {
+			http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error refreshing token: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	user, err := repository.GetUserByID(ctx, db, rotated.UserID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving user: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	token, expiresAt, err := generateJWT(user, rotated.FamilyID, rotated.AuthenticatedAt)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error generating JWT: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(LoginResponse{Token: token})
+	json.NewEncoder(w).Encode(LoginResponse{
+		Token:            token,
+		ExpiresAt:        expiresAt,
+		RefreshToken:     newRefreshToken,
+		RefreshExpiresAt: refreshExpiresAt,
+	})
+}
+
+// Logout revokes the access token it is called with and ends its session:
+// the session's refresh tokens stop working, every other access token issued
+// to it is rejected and its WebSocket connections are closed.
+func Logout(w http.ResponseWriter, r *http.Request) {
+	tokenID, ok := r.Context().Value("token_id").(uuid.UUID)
+	if !ok || tokenID == uuid.Nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	sessionID, _ := r.Context().Value("session_id").(uuid.UUID)
+	tokenExpiresAt, _ := r.Context().Value("token_expires_at").(time.Time)
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+
+	if err := repository.GetTokenRevocationStore().Revoke(ctx, db, revocationExpiry(tokenExpiresAt), tokenID); err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking token: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if sessionID != uuid.Nil {
+		if err := revokeSession(ctx, db, sessionID); err != nil {
+			http.Error(w, fmt.Sprintf("Error revoking session: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeSession ends a session and its refresh tokens, then invalidates the
+// access tokens and WebSocket connections it still has.
+func revokeSession(ctx context.Context, db *sql.DB, sessionID uuid.UUID) error {
+	if err := repository.RevokeSession(ctx, db, sessionID); err != nil {
+		return err
+	}
+	return invalidateSessionTokens(ctx, db, sessionID)
+}
+
+// invalidateSessionTokens revokes the given session ids for as long as one of
+// their access tokens could still be valid, and drops their live WebSocket
+// connections on this instance.
+func invalidateSessionTokens(ctx context.Context, db *sql.DB, sessionIDs ...uuid.UUID) error {
+	if len(sessionIDs) == 0 {
+		return nil
+	}
+
+	if err := repository.GetTokenRevocationStore().Revoke(ctx, db, revocationExpiry(time.Now().Add(accessTokenTTL())), sessionIDs...); err != nil {
+		return err
+	}
+
+	for _, sessionID := range sessionIDs {
+		GetHub().CloseSession(sessionID)
+	}
+	return nil
+}
+
+// revocationExpiry returns how long to keep a revocation for tokens that
+// expire at expiresAt: tokens are accepted for the configured leeway past
+// their exp, so the revocation must outlive them by as much.
+func revocationExpiry(expiresAt time.Time) time.Time {
+	return expiresAt.Add(utils.JwtLeeway())
 }
 
-func generateJWT(userID int64, userUuid uuid.UUID, username string, userEmail string) (string, error) {
-	jwtSecret := utils.GetJwtSecret()
+// checkRecentAuth enforces step-up authentication before a sensitive
+// operation: the caller must supply their current password, or have logged in
+// within recentAuthWindow. Otherwise it writes an error response and returns
+// false.
+func checkRecentAuth(w http.ResponseWriter, r *http.Request, db *sql.DB, currentPassword *string) bool {
+	userID, _ := r.Context().Value("user_id").(int64)
+	authTime, _ := r.Context().Value("auth_time").(time.Time)
+
+	if currentPassword == nil {
+		if time.Since(authTime) > recentAuthWindow {
+			http.Error(w, "Current password is required for this operation", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+
+	err := repository.VerifyUserPassword(r.Context(), db, userID, *currentPassword)
+	if err != nil {
+		if errors.Is(err, repository.ErrInvalidPassword) {
+			http.Error(w, "Current password is incorrect", http.StatusForbidden)
+			return false
+		}
+		http.Error(w, fmt.Sprintf("Error verifying password: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// issueTokens starts a new session for user on the device that sent r and
+// returns its first refresh token along with a fresh access token. The
+// session id doubles as the refresh token family id.
+func issueTokens(r *http.Request, db *sql.DB, user *models.User) (*LoginResponse, error) {
+	sessionID := uuid.New()
+	authenticatedAt := time.Now()
+
+	token, expiresAt, err := generateJWT(user, sessionID, authenticatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	refreshExpiresAt := time.Now().Add(refreshTokenTTL())
 
-	claims := jwt.MapClaims{
-		"user_id":   userID,
-		"user_uuid": userUuid,
-		"email":     userEmail,
-		"username":  username,
-		"exp":       time.Now().Add(time.Hour * 24).Unix(),
+	_, err = repository.CreateSession(r.Context(), db, repository.CreateSessionParams{
+		UUID:             sessionID,
+		UserID:           user.ID,
+		UserAgent:        truncate(r.UserAgent(), maxUserAgentLength),
+		IPAddress:        utils.ClientIP(r),
+		RefreshTokenHash: utils.HashToken(refreshToken),
+		ExpiresAt:        refreshExpiresAt,
+		AuthenticatedAt:  authenticatedAt,
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return &LoginResponse{
+		Token:            token,
+		ExpiresAt:        expiresAt,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refreshExpiresAt,
+	}, nil
+}
+
+// generateJWT issues an access token for user in the given session. authTime
+// is when the user last proved their identity, which sensitive operations
+// check to require a recent login.
+func generateJWT(user *models.User, sessionID uuid.UUID, authTime time.Time) (string, time.Time, error) {
+	claims := utils.Claims{
+		UserID:           user.ID,
+		UserUUID:         user.UUID,
+		Username:         user.Username,
+		Email:            user.Email,
+		SessionID:        sessionID,
+		Type:             utils.TokenTypeAccess,
+		AuthTime:         authTime.Unix(),
+		RegisteredClaims: utils.NewRegisteredClaims(utils.TokenTypeAccess, user.UUID.String(), accessTokenTTL()),
+	}
 
-	signedToken, err := token.SignedString(jwtSecret)
+	signedToken, err := utils.SignToken(claims)
 	if err != nil {
-		return "", err
+		return "", time.Time{}, err
 	}
 
-	return signedToken, nil
+	return signedToken, claims.ExpiresAt.Time, nil
+}
+
+func accessTokenTTL() time.Duration {
+	if config, err := utils.GetConfig(); err == nil && config.AccessTokenTTL > 0 {
+		return config.AccessTokenTTL
+	}
+	return defaultAccessTokenTTL
+}
+
+func refreshTokenTTL() time.Duration {
+	if config, err := utils.GetConfig(); err == nil && config.RefreshTokenTTL > 0 {
+		return config.RefreshTokenTTL
+	}
+	return defaultRefreshTokenTTL
+}
+
+func truncate(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	return strings.ToValidUTF8(s[:maxLen], "")
 }
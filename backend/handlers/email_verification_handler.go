@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/db"
+	"github.com/AndreaCasaluci/go-chat-app/mailer"
+	"github.com/AndreaCasaluci/go-chat-app/models"
+	"github.com/AndreaCasaluci/go-chat-app/repository"
+	"github.com/AndreaCasaluci/go-chat-app/utils"
+)
+
+const (
+	// How long a verification link stays valid.
+	emailVerificationTTL = 24 * time.Hour
+
+	// Minimum time between two verification emails to the same user.
+	verificationResendInterval = time.Minute
+
+	// Time allowed to deliver an email sent in the background.
+	emailSendTimeout = 30 * time.Second
+)
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type VerifyEmailResponse struct {
+	Verified bool `json:"verified"`
+}
+
+// VerifyEmail marks the address a verification token was sent to as verified.
+// GET serves the link from the email, with the token in the query string;
+// POST takes it in the body for clients that handle the link themselves.
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var verifyReq VerifyEmailRequest
+
+	if r.Method == http.MethodGet {
+		verifyReq.Token = r.URL.Query().Get("token")
+	} else if err := json.NewDecoder(r.Body).Decode(&verifyReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.ValidateStruct(verifyReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	claims, err := utils.ValidateEmailVerificationToken(verifyReq.Token)
+	if err != nil {
+		http.Error(w, "Invalid or expired verification token", http.StatusBadRequest)
+		return
+	}
+
+	userUUID, err := claims.UserUUID()
+	if err != nil {
+		http.Error(w, "Invalid or expired verification token", http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+
+	user, err := repository.GetUserByUUID(ctx, db, userUUID)
+	if err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			http.Error(w, "Invalid or expired verification token", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error retrieving user: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// The token is bound to the address it was mailed to, so a link sent
+	// before an email change cannot verify the new address.
+	verified, err := repository.MarkUserVerified(ctx, db, user.ID, claims.Email)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error verifying email: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !verified {
+		http.Error(w, "Invalid or expired verification token", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(VerifyEmailResponse{Verified: true})
+}
+
+// ResendVerificationEmail sends the caller a new verification link, at most
+// once per verificationResendInterval.
+func ResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+
+	user, err := repository.GetUserByID(ctx, db, userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving user: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	retryAfter, err := sendVerificationEmail(ctx, db, user)
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrUserAlreadyVerified):
+			http.Error(w, "Email is already verified", http.StatusConflict)
+		case errors.Is(err, repository.ErrVerificationEmailThrottled):
+			setRetryAfter(w, retryAfter)
+			http.Error(w, "Verification email sent too recently, try again later", http.StatusTooManyRequests)
+		default:
+			http.Error(w, fmt.Sprintf("Error sending verification email: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// sendVerificationEmail mails user a link verifying their current address,
+// unless they are already verified or were sent one too recently.
+func sendVerificationEmail(ctx context.Context, db *sql.DB, user *models.User) (time.Duration, error) {
+	m, err := mailer.GetMailer()
+	if err != nil {
+		return 0, err
+	}
+
+	token, err := utils.GenerateEmailVerificationToken(user.UUID, user.Email, emailVerificationTTL)
+	if err != nil {
+		return 0, err
+	}
+
+	if retryAfter, err := repository.ReserveVerificationEmail(ctx, db, user.ID, verificationResendInterval); err != nil {
+		return retryAfter, err
+	}
+
+	link, err := appLink("/verify-email", token)
+	if err != nil {
+		return 0, err
+	}
+
+	return 0, m.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nconfirm this is your email address by opening the link below:\n\n%s\n\n"+
+			"The link expires in %d hours. If you did not sign up, you can ignore this email.\n",
+			user.Username, link, int(emailVerificationTTL.Hours())),
+	})
+}
+
+// sendVerificationEmailAsync sends the verification email without holding up
+// the request that triggered it; failures are only logged since the user can
+// always ask for a new link.
+func sendVerificationEmailAsync(db *sql.DB, user *models.User) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), emailSendTimeout)
+		defer cancel()
+
+		_, err := sendVerificationEmail(ctx, db, user)
+		if err != nil && !errors.Is(err, repository.ErrUserAlreadyVerified) && !errors.Is(err, repository.ErrVerificationEmailThrottled) {
+			log.Printf("Error sending verification email to user %s: %v", user.UUID, err)
+		}
+	}()
+}
+
+// appLink builds an absolute link to path under APP_BASE_URL carrying token,
+// for inclusion in emails.
+func appLink(path string, token string) (string, error) {
+	config, err := utils.GetConfig()
+	if err != nil {
+		return "", err
+	}
+
+	baseURL := strings.TrimRight(config.AppBaseURL, "/")
+	if baseURL == "" {
+		return "", fmt.Errorf("APP_BASE_URL is not set")
+	}
+	return baseURL + path + "?token=" + url.QueryEscape(token), nil
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/utils"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+)
+
+var (
+	mailSeparator           = regexp.MustCompile(`(?m)^Date: `)
+	verificationLinkPattern = regexp.MustCompile(`http://localhost:8080/verify-email\?token=\S+`)
+)
+
+// mailedVerificationLinks returns the verification links in the mail log
+// that were sent to the given address.
+func mailedVerificationLinks(t *testing.T, to string) []string {
+	t.Helper()
+
+	raw, err := os.ReadFile(utils.AppConfig.MailLogFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("could not read mail log: %v", err)
+	}
+
+	recipient := regexp.MustCompile(`(?m)^To: ` + regexp.QuoteMeta(to) + `$`)
+
+	var links []string
+	for _, message := range mailSeparator.Split(string(raw), -1) {
+		if recipient.MatchString(message) {
+			links = append(links, verificationLinkPattern.FindAllString(message, -1)...)
+		}
+	}
+	return links
+}
+
+func TestVerificationEmailRoundTrip(t *testing.T) {
+	mock := newMockDb(t)
+
+	userUUID := uuid.New()
+	email := userUUID.String() + "@example.com"
+	now := time.Now().UTC()
+	userRow := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "uuid", "username", "email", "verified", "created_at", "updated_at"}).
+			AddRow(5, userUUID.String(), "alice", email, false, now, now)
+	}
+
+	// The first request reserves the send and mails a link.
+	mock.ExpectQuery(`FROM users WHERE id = \$1`).WithArgs(int64(5)).WillReturnRows(userRow())
+	mock.ExpectExec(`UPDATE users SET verification_sent_at = CURRENT_TIMESTAMP`).
+		WithArgs(int64(5), verificationResendInterval.Seconds()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rec := httptest.NewRecorder()
+	ResendVerificationEmail(rec, withUser(httptest.NewRequest(http.MethodPost, "/verify-email/resend", nil), 5, userUUID))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("ResendVerificationEmail returned %d, want %d: %s", rec.Code, http.StatusAccepted, rec.Body.String())
+	}
+
+	links := mailedVerificationLinks(t, email)
+	if len(links) != 1 {
+		t.Fatalf("mailed links %v, want exactly one", links)
+	}
+
+	// A second request within the resend interval is throttled and mails
+	// nothing.
+	mock.ExpectQuery(`FROM users WHERE id = \$1`).WithArgs(int64(5)).WillReturnRows(userRow())
+	mock.ExpectExec(`UPDATE users SET verification_sent_at = CURRENT_TIMESTAMP`).
+		WithArgs(int64(5), verificationResendInterval.Seconds()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT verified, EXTRACT\(EPOCH FROM verification_sent_at`).
+		WithArgs(int64(5), verificationResendInterval.Seconds()).
+		WillReturnRows(sqlmock.NewRows([]string{"verified", "wait"}).AddRow(false, 42.5))
+
+	rec = httptest.NewRecorder()
+	ResendVerificationEmail(rec, withUser(httptest.NewRequest(http.MethodPost, "/verify-email/resend", nil), 5, userUUID))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("ResendVerificationEmail returned %d, want %d: %s", rec.Code, http.StatusTooManyRequests, rec.Body.String())
+	}
+	if retryAfter, _ := strconv.Atoi(rec.Header().Get("Retry-After")); retryAfter != 43 {
+		t.Errorf("Retry-After %q, want 43", rec.Header().Get("Retry-After"))
+	}
+	if links := mailedVerificationLinks(t, email); len(links) != 1 {
+		t.Errorf("throttled request mailed a link: %v", links)
+	}
+
+	// Opening the mailed link verifies the address it was sent to.
+	link, err := url.Parse(links[0])
+	if err != nil {
+		t.Fatalf("invalid link %q: %v", links[0], err)
+	}
+
+	mock.ExpectQuery(`FROM users WHERE uuid = \$1`).WithArgs(userUUID).WillReturnRows(userRow())
+	mock.ExpectExec(`UPDATE users SET verified = TRUE`).
+		WithArgs(int64(5), email).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rec = httptest.NewRecorder()
+	VerifyEmail(rec, httptest.NewRequest(http.MethodGet, link.RequestURI(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("VerifyEmail returned %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	var response VerifyEmailResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil || !response.Verified {
+		t.Errorf("VerifyEmail response %+v, %v; want verified", response, err)
+	}
+}
+
+func TestVerifyEmailRejectsOtherTokens(t *testing.T) {
+	userUUID := uuid.New()
+
+	// A token issued for another purpose must not verify anything, even
+	// though it is signed with the same key.
+	mfaToken, _, err := utils.GenerateMFAPendingToken(userUUID, time.Minute)
+	if err != nil {
+		t.Fatalf("could not generate token: %v", err)
+	}
+
+	for _, token := range []string{mfaToken, "not-a-token"} {
+		rec := httptest.NewRecorder()
+		VerifyEmail(rec, httptest.NewRequest(http.MethodGet, "/verify-email?token="+url.QueryEscape(token), nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("VerifyEmail returned %d for %q, want %d", rec.Code, token, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/models"
+	"github.com/AndreaCasaluci/go-chat-app/repository"
+	"github.com/google/uuid"
+)
+
+// How long a cached group membership is trusted before it is reloaded. Every
+// local membership change invalidates the entry immediately; the TTL bounds
+// staleness for changes made by other server instances.
+const groupCacheTTL = time.Minute
+
+// GroupMembershipCache keeps the members of recently active groups in memory
+// so that fanning out a group message does not hit Postgres on every frame.
+//
+// Loads run outside the lock, so a load that started before an Invalidate
+// could store the outdated membership it read once the change is made. Every
+// Invalidate bumps the generation of its group and a load only stores its
+// result when the generation is still the one it started with.
+type GroupMembershipCache struct {
+	mu          sync.RWMutex
+	groups      map[uuid.UUID]*cachedGroup
+	generations map[uuid.UUID]uint64
+	// sweeps counts how often generations was cleared; a load that overlaps
+	// a sweep cannot tell whether it missed an Invalidate and does not store.
+	sweeps    uint64
+	lastSweep time.Time
+}
+
+type cachedGroup struct {
+	group    *models.GroupChat
+	members  map[int64]models.GroupMember
+	loadedAt time.Time
+}
+
+var groupCache = NewGroupMembershipCache()
+
+func NewGroupMembershipCache() *GroupMembershipCache {
+	return &GroupMembershipCache{
+		groups:      make(map[uuid.UUID]*cachedGroup),
+		generations: make(map[uuid.UUID]uint64),
+		lastSweep:   time.Now(),
+	}
+}
+
+func GetGroupCache() *GroupMembershipCache {
+	return groupCache
+}
+
+// Get returns the group and its members, loading them from the database when
+// they are not cached or the cached entry has expired.
+func (c *GroupMembershipCache) Get(ctx context.Context, db *sql.DB, groupUUID uuid.UUID) (*models.GroupChat, map[int64]models.GroupMember, error) {
+	c.mu.RLock()
+	entry, ok := c.groups[groupUUID]
+	generation, sweeps := c.generations[groupUUID], c.sweeps
+	c.mu.RUnlock()
+
+	if ok && time.Since(entry.loadedAt) < groupCacheTTL {
+		return entry.group, entry.members, nil
+	}
+
+	group, err := repository.GetGroupByUUID(ctx, db, groupUUID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	memberList, err := repository.ListGroupMembers(ctx, db, group.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	members := make(map[int64]models.GroupMember, len(memberList))
+	for _, member := range memberList {
+		members[member.UserID] = member
+	}
+
+	c.mu.Lock()
+	if c.generations[groupUUID] == generation && c.sweeps == sweeps {
+		c.groups[groupUUID] = &cachedGroup{group: group, members: members, loadedAt: time.Now()}
+	}
+	c.sweep(time.Now())
+	c.mu.Unlock()
+
+	return group, members, nil
+}
+
+// Invalidate drops the cached entry of a group; call it whenever the group or
+// its membership changes.
+func (c *GroupMembershipCache) Invalidate(groupUUID uuid.UUID) {
+	c.mu.Lock()
+	delete(c.groups, groupUUID)
+	c.generations[groupUUID]++
+	c.mu.Unlock()
+}
+
+// sweep drops expired entries and the recorded generations at most once per
+// minute so the maps do not grow with every group ever touched. The caller
+// must hold the write lock.
+func (c *GroupMembershipCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < time.Minute {
+		return
+	}
+	for groupUUID, entry := range c.groups {
+		if now.Sub(entry.loadedAt) >= groupCacheTTL {
+			delete(c.groups, groupUUID)
+		}
+	}
+	if len(c.generations) > 0 {
+		clear(c.generations)
+		c.sweeps++
+	}
+	c.lastSweep = now
+}
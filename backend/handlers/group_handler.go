@@ -0,0 +1,592 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/db"
+	"github.com/AndreaCasaluci/go-chat-app/models"
+	"github.com/AndreaCasaluci/go-chat-app/repository"
+	"github.com/AndreaCasaluci/go-chat-app/utils"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+type GroupResponse struct {
+	UUID             string    `json:"uuid"`
+	Name             string    `json:"name"`
+	CreatedBy        string    `json:"created_by"`
+	AnnouncementOnly bool      `json:"announcement_only"`
+	SlowModeSeconds  int       `json:"slow_mode_seconds"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+type GroupMemberResponse struct {
+	UserUUID string    `json:"user_uuid"`
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+type CreateGroupRequest struct {
+	Name        string   `json:"name" validate:"required,min=1,max=255"`
+	MemberUUIDs []string `json:"member_uuids" validate:"max=256,dive,uuid"`
+}
+
+type UpdateGroupRequest struct {
+	Name             *string `json:"name" validate:"omitnil,min=1,max=255"`
+	AnnouncementOnly *bool   `json:"announcement_only"`
+	SlowModeSeconds  *int    `json:"slow_mode_seconds" validate:"omitnil,min=0,max=21600"`
+}
+
+type AddGroupMemberRequest struct {
+	UserUUID string `json:"user_uuid" validate:"required,uuid"`
+}
+
+type UpdateGroupMemberRequest struct {
+	Role string `json:"role" validate:"required,oneof=admin member"`
+}
+
+type TransferGroupOwnershipRequest struct {
+	UserUUID string `json:"user_uuid" validate:"required,uuid"`
+}
+
+func CreateGroup(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var groupReq CreateGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&groupReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.ValidateStruct(groupReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+
+	memberUUIDs := make([]uuid.UUID, 0, len(groupReq.MemberUUIDs))
+	for _, memberUUID := range groupReq.MemberUUIDs {
+		memberUUIDs = append(memberUUIDs, uuid.MustParse(memberUUID))
+	}
+
+	members, err := repository.GetUsersByUUIDs(ctx, db, memberUUIDs)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving members: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	memberIDs := make([]int64, 0, len(members))
+	found := make(map[uuid.UUID]bool, len(members))
+	for _, member := range members {
+		memberIDs = append(memberIDs, member.ID)
+		found[member.UUID] = true
+	}
+	for _, memberUUID := range memberUUIDs {
+		if !found[memberUUID] {
+			http.Error(w, fmt.Sprintf("User %s not found", memberUUID), http.StatusBadRequest)
+			return
+		}
+	}
+
+	group, err := repository.CreateGroup(ctx, db, repository.CreateGroupParams{Name: groupReq.Name, CreatedBy: userID, MemberIDs: memberIDs})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating group: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newGroupResponse(group))
+}
+
+func ListGroups(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	groups, err := repository.ListUserGroups(r.Context(), db, userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving groups: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]GroupResponse, 0, len(groups))
+	for i := range groups {
+		response = append(response, newGroupResponse(&groups[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func GetGroup(w http.ResponseWriter, r *http.Request) {
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	group, _, ok := loadGroupForMember(w, r, db)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(newGroupResponse(group))
+}
+
+func UpdateGroup(w http.ResponseWriter, r *http.Request) {
+	var groupReq UpdateGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&groupReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.ValidateStruct(groupReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	group, member, ok := loadGroupForMember(w, r, db)
+	if !ok {
+		return
+	}
+
+	if !member.Role.CanManageGroup() {
+		http.Error(w, "Only group owners and admins can update the group", http.StatusForbidden)
+		return
+	}
+
+	updatedGroup, err := repository.UpdateGroup(r.Context(), db, repository.UpdateGroupParams{
+		GroupID:          group.ID,
+		Name:             groupReq.Name,
+		AnnouncementOnly: groupReq.AnnouncementOnly,
+		SlowModeSeconds:  groupReq.SlowModeSeconds,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating group: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	GetGroupCache().Invalidate(group.UUID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(newGroupResponse(updatedGroup))
+}
+
+func DeleteGroup(w http.ResponseWriter, r *http.Request) {
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	group, member, ok := loadGroupForMember(w, r, db)
+	if !ok {
+		return
+	}
+
+	if !member.Role.CanDeleteGroup() {
+		http.Error(w, "Only the group owner can delete the group", http.StatusForbidden)
+		return
+	}
+
+	if err := repository.DeleteGroup(r.Context(), db, group.ID); err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting group: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	GetGroupCache().Invalidate(group.UUID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func ListGroupMembers(w http.ResponseWriter, r *http.Request) {
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	group, _, ok := loadGroupForMember(w, r, db)
+	if !ok {
+		return
+	}
+
+	members, err := repository.ListGroupMembers(r.Context(), db, group.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving group members: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]GroupMemberResponse, 0, len(members))
+	for i := range members {
+		response = append(response, newGroupMemberResponse(&members[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func AddGroupMember(w http.ResponseWriter, r *http.Request) {
+	var memberReq AddGroupMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&memberReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.ValidateStruct(memberReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	group, member, ok := loadGroupForMember(w, r, db)
+	if !ok {
+		return
+	}
+
+	if !member.Role.CanAddMembers() {
+		http.Error(w, "Only group owners and admins can add members", http.StatusForbidden)
+		return
+	}
+
+	ctx := r.Context()
+
+	user, err := repository.GetUserByUUID(ctx, db, uuid.MustParse(memberReq.UserUUID))
+	if err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error retrieving user: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := repository.AddGroupMember(ctx, db, group.ID, user.ID); err != nil {
+		if errors.Is(err, repository.ErrAlreadyGroupMember) {
+			http.Error(w, "User is already a member of the group", http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error adding group member: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	GetGroupCache().Invalidate(group.UUID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func RemoveGroupMember(w http.ResponseWriter, r *http.Request) {
+	memberUUID, err := uuid.Parse(mux.Vars(r)["user_uuid"])
+	if err != nil {
+		http.Error(w, "Invalid user UUID", http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	group, member, ok := loadGroupForMember(w, r, db)
+	if !ok {
+		return
+	}
+
+	if memberUUID == member.UserUUID {
+		http.Error(w, "Use the leave endpoint to leave a group", http.StatusBadRequest)
+		return
+	}
+
+	target, ok := loadTargetGroupMember(w, r, db, group, memberUUID)
+	if !ok {
+		return
+	}
+
+	if !member.Role.CanRemoveMember(target.Role) {
+		http.Error(w, "You are not allowed to remove this member", http.StatusForbidden)
+		return
+	}
+
+	if err := repository.RemoveGroupMember(r.Context(), db, group.ID, target.UserID); err != nil {
+		if errors.Is(err, repository.ErrNotGroupMember) {
+			http.Error(w, "User is not a member of the group", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error removing group member: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	GetGroupCache().Invalidate(group.UUID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func LeaveGroup(w http.ResponseWriter, r *http.Request) {
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	group, member, ok := loadGroupForMember(w, r, db)
+	if !ok {
+		return
+	}
+
+	if _, err := repository.LeaveGroup(r.Context(), db, group.ID, member.UserID); err != nil {
+		if errors.Is(err, repository.ErrNotGroupMember) {
+			http.Error(w, "Group not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error leaving group: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	GetGroupCache().Invalidate(group.UUID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func UpdateGroupMember(w http.ResponseWriter, r *http.Request) {
+	memberUUID, err := uuid.Parse(mux.Vars(r)["user_uuid"])
+	if err != nil {
+		http.Error(w, "Invalid user UUID", http.StatusBadRequest)
+		return
+	}
+
+	var memberReq UpdateGroupMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&memberReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.ValidateStruct(memberReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	group, member, ok := loadGroupForMember(w, r, db)
+	if !ok {
+		return
+	}
+
+	if !member.Role.CanChangeRoles() {
+		http.Error(w, "Only the group owner can change member roles", http.StatusForbidden)
+		return
+	}
+
+	if memberUUID == member.UserUUID {
+		http.Error(w, "Transfer ownership to change your own role", http.StatusBadRequest)
+		return
+	}
+
+	target, ok := loadTargetGroupMember(w, r, db, group, memberUUID)
+	if !ok {
+		return
+	}
+
+	target.Role = models.GroupRole(memberReq.Role)
+	if err := repository.UpdateGroupMemberRole(r.Context(), db, group.ID, target.UserID, target.Role); err != nil {
+		http.Error(w, fmt.Sprintf("Error updating group member: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	GetGroupCache().Invalidate(group.UUID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(newGroupMemberResponse(target))
+}
+
+func TransferGroupOwnership(w http.ResponseWriter, r *http.Request) {
+	var transferReq TransferGroupOwnershipRequest
+	if err := json.NewDecoder(r.Body).Decode(&transferReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.ValidateStruct(transferReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	group, member, ok := loadGroupForMember(w, r, db)
+	if !ok {
+		return
+	}
+
+	if member.Role != models.GroupRoleOwner {
+		http.Error(w, "Only the group owner can transfer ownership", http.StatusForbidden)
+		return
+	}
+
+	newOwnerUUID := uuid.MustParse(transferReq.UserUUID)
+	if newOwnerUUID == member.UserUUID {
+		http.Error(w, "You already own this group", http.StatusBadRequest)
+		return
+	}
+
+	target, ok := loadTargetGroupMember(w, r, db, group, newOwnerUUID)
+	if !ok {
+		return
+	}
+
+	if err := repository.TransferGroupOwnership(r.Context(), db, group.ID, member.UserID, target.UserID); err != nil {
+		if errors.Is(err, repository.ErrNotGroupMember) {
+			http.Error(w, "User is not a member of the group", http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error transferring group ownership: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	GetGroupCache().Invalidate(group.UUID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadGroupForMember resolves the {uuid} route variable to a group the
+// authenticated user belongs to. On failure it writes the error response and
+// returns false; non-members get a 404 so they cannot probe for groups.
+func loadGroupForMember(w http.ResponseWriter, r *http.Request, db *sql.DB) (*models.GroupChat, *models.GroupMember, bool) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, nil, false
+	}
+
+	groupUUID, err := uuid.Parse(mux.Vars(r)["uuid"])
+	if err != nil {
+		http.Error(w, "Invalid group UUID", http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	ctx := r.Context()
+
+	group, err := repository.GetGroupByUUID(ctx, db, groupUUID)
+	if err != nil {
+		if errors.Is(err, repository.ErrGroupNotFound) {
+			http.Error(w, "Group not found", http.StatusNotFound)
+			return nil, nil, false
+		}
+		http.Error(w, fmt.Sprintf("Error retrieving group: %v", err), http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	member, err := repository.GetGroupMember(ctx, db, group.ID, userID)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotGroupMember) {
+			http.Error(w, "Group not found", http.StatusNotFound)
+			return nil, nil, false
+		}
+		http.Error(w, fmt.Sprintf("Error checking group membership: %v", err), http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	return group, member, true
+}
+
+// loadTargetGroupMember resolves the member an action applies to, writing a
+// 404 when the user does not exist or does not belong to the group.
+func loadTargetGroupMember(w http.ResponseWriter, r *http.Request, db *sql.DB, group *models.GroupChat, userUUID uuid.UUID) (*models.GroupMember, bool) {
+	ctx := r.Context()
+
+	user, err := repository.GetUserByUUID(ctx, db, userUUID)
+	if err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, fmt.Sprintf("Error retrieving user: %v", err), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	member, err := repository.GetGroupMember(ctx, db, group.ID, user.ID)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotGroupMember) {
+			http.Error(w, "User is not a member of the group", http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, fmt.Sprintf("Error checking group membership: %v", err), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return member, true
+}
+
+func newGroupResponse(group *models.GroupChat) GroupResponse {
+	return GroupResponse{
+		UUID:             group.UUID.String(),
+		Name:             group.Name,
+		CreatedBy:        group.CreatedByUUID.String(),
+		AnnouncementOnly: group.AnnouncementOnly,
+		SlowModeSeconds:  group.SlowModeSeconds,
+		CreatedAt:        group.CreatedAt,
+		UpdatedAt:        group.UpdatedAt,
+	}
+}
+
+func newGroupMemberResponse(member *models.GroupMember) GroupMemberResponse {
+	return GroupMemberResponse{
+		UserUUID: member.UserUUID.String(),
+		Username: member.Username,
+		Role:     string(member.Role),
+		JoinedAt: member.JoinedAt,
+	}
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"sync"
+
+	"github.com/AndreaCasaluci/go-chat-app/models"
+	"github.com/google/uuid"
+)
+
+// Hub tracks every live WebSocket connection, grouped by the UUID of the
+// user that opened it, so frames can be routed to all of a user's devices.
+type Hub struct {
+	mu      sync.RWMutex
+	clients map[uuid.UUID]map[*Client]struct{}
+}
+
+var hub = NewHub()
+
+func NewHub() *Hub {
+	return &Hub{
+		clients: make(map[uuid.UUID]map[*Client]struct{}),
+	}
+}
+
+func GetHub() *Hub {
+	return hub
+}
+
+func (h *Hub) Register(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	connections, ok := h.clients[client.UserUUID]
+	if !ok {
+		connections = make(map[*Client]struct{})
+		h.clients[client.UserUUID] = connections
+	}
+	connections[client] = struct{}{}
+}
+
+func (h *Hub) Unregister(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	connections, ok := h.clients[client.UserUUID]
+	if !ok {
+		return
+	}
+	if _, ok := connections[client]; !ok {
+		return
+	}
+
+	delete(connections, client)
+	if len(connections) == 0 {
+		delete(h.clients, client.UserUUID)
+	}
+	client.closeSend()
+}
+
+// SendToUser queues payload on every open connection of the given user and
+// returns the number of connections it was delivered to. Connections opened
+// with a personal access token lacking messages:read are skipped.
+func (h *Hub) SendToUser(userUUID uuid.UUID, payload []byte) int {
+	return h.sendToUser(userUUID, payload, nil)
+}
+
+// SendToUserExcept behaves like SendToUser but skips the given connection,
+// typically the one the payload originated from.
+func (h *Hub) SendToUserExcept(userUUID uuid.UUID, payload []byte, except *Client) int {
+	return h.sendToUser(userUUID, payload, except)
+}
+
+func (h *Hub) sendToUser(userUUID uuid.UUID, payload []byte, except *Client) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	delivered := 0
+	for client := range h.clients[userUUID] {
+		if client == except || !client.hasScope(models.ScopeMessagesRead) {
+			continue
+		}
+		if client.enqueue(payload) {
+			delivered++
+		}
+	}
+	return delivered
+}
+
+func (h *Hub) IsOnline(userUUID uuid.UUID) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.clients[userUUID]) > 0
+}
+
+func (h *Hub) ConnectionCount(userUUID uuid.UUID) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.clients[userUUID])
+}
+
+// CloseSession drops every live connection opened with an access token of
+// the given session, used when the session is revoked.
+func (h *Hub) CloseSession(sessionID uuid.UUID) {
+	h.mu.RLock()
+	var clients []*Client
+	for _, connections := range h.clients {
+		for client := range connections {
+			if client.SessionID == sessionID {
+				clients = append(clients, client)
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, client := range clients {
+		client.Close()
+	}
+}
+
+// CloseAll drops every live connection, used on server shutdown since
+// http.Server.Shutdown does not track hijacked connections.
+func (h *Hub) CloseAll() {
+	h.mu.RLock()
+	var clients []*Client
+	for _, connections := range h.clients {
+		for client := range connections {
+			clients = append(clients, client)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, client := range clients {
+		client.Close()
+	}
+}
@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/AndreaCasaluci/go-chat-app/utils"
+)
+
+// GetJWKS publishes the public keys access tokens are signed with, so that
+// other services can verify them without sharing a secret.
+func GetJWKS(w http.ResponseWriter, r *http.Request) {
+	keySet, err := utils.GetKeySet()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not load signing keys: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(keySet.JWKS())
+}
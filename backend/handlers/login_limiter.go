@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/ratelimit"
+	"github.com/google/uuid"
+)
+
+var (
+	// accountLoginPolicy guards a single account against password guessing.
+	accountLoginPolicy = ratelimit.Policy{
+		FreeAttempts: 5,
+		BaseLockout:  30 * time.Second,
+		MaxLockout:   15 * time.Minute,
+		Window:       time.Hour,
+	}
+	// ipLoginPolicy is looser, since many users may share an address, and
+	// stops one client from spreading guesses over many accounts.
+	ipLoginPolicy = ratelimit.Policy{
+		FreeAttempts: 20,
+		BaseLockout:  30 * time.Second,
+		MaxLockout:   15 * time.Minute,
+		Window:       time.Hour,
+	}
+	// mfaLoginPolicy guards the second factor, whose six digit codes would
+	// otherwise fall to brute force well within the pending token lifetime.
+	mfaLoginPolicy = ratelimit.Policy{
+		FreeAttempts: 5,
+		BaseLockout:  30 * time.Second,
+		MaxLockout:   15 * time.Minute,
+		Window:       time.Hour,
+	}
+)
+
+// loginKey pairs a limiter key with the policy applied to its failures.
+type loginKey struct {
+	key    string
+	policy ratelimit.Policy
+}
+
+func accountLoginKey(email string) loginKey {
+	return loginKey{key: "login:account:" + strings.ToLower(email), policy: accountLoginPolicy}
+}
+
+func ipLoginKey(ip string) loginKey {
+	return loginKey{key: "login:ip:" + ip, policy: ipLoginPolicy}
+}
+
+func mfaLoginKey(userUUID uuid.UUID) loginKey {
+	return loginKey{key: "login:mfa:" + userUUID.String(), policy: mfaLoginPolicy}
+}
+
+// reserveLoginAttempt counts an attempt against every key before it is
+// made. It returns the longest lockout among keys, or zero if the attempt may
+// proceed; a refused attempt is not counted against any key.
+func reserveLoginAttempt(ctx context.Context, limiter ratelimit.LoginLimiter, keys ...loginKey) (time.Duration, error) {
+	var retryAfter time.Duration
+	var reserved []loginKey
+	for _, k := range keys {
+		lockout, err := limiter.Reserve(ctx, k.key, k.policy)
+		if err != nil {
+			releaseLoginAttempt(ctx, limiter, reserved...)
+			return 0, err
+		}
+		if lockout > retryAfter {
+			retryAfter = lockout
+		}
+		if lockout == 0 {
+			reserved = append(reserved, k)
+		}
+	}
+
+	if retryAfter > 0 {
+		releaseLoginAttempt(ctx, limiter, reserved...)
+	}
+	return retryAfter, nil
+}
+
+// releaseLoginAttempt gives back an attempt reserved against keys that turned
+// out not to be a failure. Errors are only logged.
+func releaseLoginAttempt(ctx context.Context, limiter ratelimit.LoginLimiter, keys ...loginKey) {
+	for _, k := range keys {
+		if err := limiter.Release(ctx, k.key, k.policy); err != nil {
+			log.Printf("Error releasing login attempt for %s: %v", k.key, err)
+		}
+	}
+}
+
+// resetLoginFailures forgets the failures of keys after a successful attempt.
+func resetLoginFailures(ctx context.Context, limiter ratelimit.LoginLimiter, keys ...loginKey) {
+	for _, k := range keys {
+		if err := limiter.Reset(ctx, k.key); err != nil {
+			log.Printf("Error resetting failed logins for %s: %v", k.key, err)
+		}
+	}
+}
+
+func writeLoginLocked(w http.ResponseWriter, retryAfter time.Duration) {
+	setRetryAfter(w, retryAfter)
+	http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+}
+
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+}
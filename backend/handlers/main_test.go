@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AndreaCasaluci/go-chat-app/db"
+	"github.com/AndreaCasaluci/go-chat-app/utils"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+)
+
+// testDir holds the local object storage and the mail log of the tests.
+var testDir string
+
+// TestMain replaces the .env file with a configuration for the tests: local
+// object storage and a log mailer in a temporary directory, and the fake OIDC
+// issuer that sso.GetProvider discovers on first use.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "handlers-test-*")
+	if err != nil {
+		panic(err)
+	}
+	testDir = dir
+
+	oidcIssuer = newFakeIssuer()
+
+	utils.AppConfig = &utils.Config{
+		JwtSecretKey:     "handlers-test-secret",
+		AppBaseURL:       "http://localhost:8080",
+		StorageBackend:   "local",
+		StorageDir:       filepath.Join(testDir, "storage"),
+		MailerBackend:    "log",
+		MailLogFile:      filepath.Join(testDir, "mail.log"),
+		OIDCProviderName: "fake",
+		OIDCIssuerURL:    oidcIssuer.URL(),
+		OIDCClientID:     fakeIssuerClientID,
+		OIDCClientSecret: fakeIssuerClientSecret,
+	}
+
+	code := m.Run()
+	oidcIssuer.Close()
+	os.RemoveAll(testDir)
+	os.Exit(code)
+}
+
+// newMockDb makes database.GetDb return a sqlmock connection for the rest of
+// the test, whose expectations must all be met by the end of it. Queries are
+// matched as regular expressions.
+func newMockDb(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("could not create mock database: %v", err)
+	}
+	database.DB = db
+
+	t.Cleanup(func() {
+		database.DB = nil
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet database expectations: %v", err)
+		}
+		db.Close()
+	})
+	return mock
+}
+
+// withUser returns r as JWTMiddleware would pass it on for the given user.
+func withUser(r *http.Request, userID int64, userUUID uuid.UUID) *http.Request {
+	ctx := context.WithValue(r.Context(), "user_id", userID)
+	ctx = context.WithValue(ctx, "user_uuid", userUUID)
+	return r.WithContext(ctx)
+}
@@ -0,0 +1,421 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/db"
+	"github.com/AndreaCasaluci/go-chat-app/imaging"
+	"github.com/AndreaCasaluci/go-chat-app/models"
+	"github.com/AndreaCasaluci/go-chat-app/repository"
+	"github.com/AndreaCasaluci/go-chat-app/storage"
+	"github.com/AndreaCasaluci/go-chat-app/utils"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultMaxUploadMB = 25
+
+	// Lifetime of presigned download URLs.
+	mediaURLExpiry = 5 * time.Minute
+
+	// Room for the multipart boundaries and headers around the file itself.
+	multipartOverhead = 1 << 20
+)
+
+// allowedMediaTypes maps the sniffed content types accepted for upload to the
+// media_type stored on messages.
+var allowedMediaTypes = map[string]string{
+	"image/jpeg": "image",
+	"image/png":  "image",
+	"image/gif":  "image",
+	"image/webp": "image",
+	"video/mp4":  "video",
+	"video/webm": "video",
+}
+
+type MediaResponse struct {
+	UUID         string    `json:"uuid"`
+	MediaType    string    `json:"media_type"`
+	ContentType  string    `json:"content_type"`
+	SizeBytes    int64     `json:"size_bytes"`
+	Width        int       `json:"width,omitempty"`
+	Height       int       `json:"height,omitempty"`
+	ThumbnailURL string    `json:"thumbnail_url,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// UploadMedia stores a single multipart "file" field in object storage. The
+// content type is sniffed from the bytes rather than trusted from the client,
+// and the returned UUID is what messages use to reference the upload.
+func UploadMedia(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userUUID, _ := r.Context().Value("user_uuid").(uuid.UUID)
+
+	config, err := utils.GetConfig()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not load config: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	maxUploadMB := config.MaxUploadMB
+	if maxUploadMB <= 0 {
+		maxUploadMB = defaultMaxUploadMB
+	}
+	maxBytes := maxUploadMB << 20
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+multipartOverhead)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var part io.ReadCloser
+	for {
+		nextPart, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeUploadReadError(w, err)
+			return
+		}
+		if nextPart.FormName() == "file" {
+			part = nextPart
+			break
+		}
+		nextPart.Close()
+	}
+	if part == nil {
+		http.Error(w, "Invalid request: missing file field", http.StatusBadRequest)
+		return
+	}
+	defer part.Close()
+
+	// Spool to disk first: the size has to be known before the object store
+	// accepts the upload, and the head is needed to sniff the content type.
+	tmp, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error buffering upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	size, err := io.Copy(tmp, io.LimitReader(part, maxBytes+1))
+	if err != nil {
+		writeUploadReadError(w, err)
+		return
+	}
+	if size > maxBytes {
+		http.Error(w, fmt.Sprintf("File exceeds the %d MB upload limit", maxUploadMB), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if size == 0 {
+		http.Error(w, "Invalid request: empty file", http.StatusBadRequest)
+		return
+	}
+
+	head := make([]byte, 512)
+	n, err := tmp.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		http.Error(w, fmt.Sprintf("Error reading upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	mediaType, ok := allowedMediaTypes[contentType]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unsupported media type: %s", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, fmt.Sprintf("Error reading upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+
+	var body io.Reader = tmp
+	var processed *imaging.ProcessedImage
+
+	switch mediaType {
+	case "image":
+		data, err := io.ReadAll(tmp)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading upload: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		processed, err = imaging.ProcessImage(data, contentType)
+		if err != nil {
+			if errors.Is(err, imaging.ErrImageTooLarge) || errors.Is(err, imaging.ErrInvalidImage) {
+				http.Error(w, fmt.Sprintf("Invalid image: %v", err), http.StatusUnprocessableEntity)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Error processing image: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		// Store the copy without EXIF so location data never leaves the server.
+		body = bytes.NewReader(processed.Data)
+		size = int64(len(processed.Data))
+	case "video":
+		processed, err = imaging.ProcessVideoPoster(ctx, tmp.Name())
+		if err != nil {
+			// A missing poster only degrades the chat list, so keep the upload.
+			if !errors.Is(err, imaging.ErrFFmpegUnavailable) {
+				log.Printf("Error generating video poster: %v", err)
+			}
+			processed = nil
+		}
+	}
+
+	store, err := storage.GetStorage()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to object storage: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	mediaUUID := uuid.New()
+	objectKey := fmt.Sprintf("media/%s/%s", userUUID, mediaUUID)
+
+	if err := store.Put(ctx, objectKey, body, size, contentType); err != nil {
+		http.Error(w, fmt.Sprintf("Error storing upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	storedKeys := []string{objectKey}
+
+	mediaParams := repository.CreateMediaParams{
+		UUID:        mediaUUID,
+		OwnerID:     userID,
+		ObjectKey:   objectKey,
+		MediaType:   mediaType,
+		ContentType: contentType,
+		SizeBytes:   size,
+	}
+
+	if processed != nil {
+		thumbnailKey := objectKey + ".thumb"
+		err := store.Put(ctx, thumbnailKey, bytes.NewReader(processed.Thumbnail), int64(len(processed.Thumbnail)), processed.ThumbnailContentType)
+		if err != nil {
+			deleteObjects(ctx, store, storedKeys)
+			http.Error(w, fmt.Sprintf("Error storing thumbnail: %v", err), http.StatusInternalServerError)
+			return
+		}
+		storedKeys = append(storedKeys, thumbnailKey)
+
+		mediaParams.Width = processed.Width
+		mediaParams.Height = processed.Height
+		mediaParams.ThumbnailKey = thumbnailKey
+	}
+
+	media, err := repository.CreateMedia(ctx, db, mediaParams)
+	if err != nil {
+		deleteObjects(ctx, store, storedKeys)
+		http.Error(w, fmt.Sprintf("Error saving upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newMediaResponse(media))
+}
+
+type MediaURLResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// GetMessageMedia gives the sender, the receiver or a member of the group a
+// short-lived presigned URL for a message attachment. Backends that cannot
+// presign stream the object through the server after the same check.
+// ?variant=thumbnail selects the generated thumbnail or video poster.
+func GetMessageMedia(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	messageUUID, err := uuid.Parse(mux.Vars(r)["uuid"])
+	if err != nil {
+		http.Error(w, "Invalid message UUID", http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+
+	message, err := repository.GetMessageByUUID(ctx, db, messageUUID)
+	if err != nil {
+		if errors.Is(err, repository.ErrMessageNotFound) {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error retrieving message: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	canAccess, err := canAccessMessage(r, db, message, userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking message access: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !canAccess {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	if message.Media == nil {
+		http.Error(w, "Message has no media", http.StatusNotFound)
+		return
+	}
+
+	objectKey := message.Media.ObjectKey
+	switch r.URL.Query().Get("variant") {
+	case "", "original":
+	case "thumbnail":
+		if message.Media.ThumbnailKey == "" {
+			http.Error(w, "Media has no thumbnail", http.StatusNotFound)
+			return
+		}
+		objectKey = message.Media.ThumbnailKey
+	default:
+		http.Error(w, "Invalid media variant", http.StatusBadRequest)
+		return
+	}
+
+	store, err := storage.GetStorage()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to object storage: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	serveMediaObject(w, r, store, objectKey)
+}
+
+func serveMediaObject(w http.ResponseWriter, r *http.Request, store storage.ObjectStorage, objectKey string) {
+	ctx := r.Context()
+
+	expiresAt := time.Now().Add(mediaURLExpiry)
+	presignedURL, err := store.PresignGet(ctx, objectKey, mediaURLExpiry)
+	if err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(MediaURLResponse{URL: presignedURL, ExpiresAt: expiresAt})
+		return
+	}
+	if !errors.Is(err, storage.ErrPresignNotSupported) {
+		http.Error(w, fmt.Sprintf("Error signing media URL: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	object, info, err := store.Get(ctx, objectKey)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			http.Error(w, "Media not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error retrieving media: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer object.Close()
+
+	w.Header().Set("Content-Type", info.ContentType)
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	// Range requests matter for video playback, so prefer ServeContent.
+	if seeker, ok := object.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", info.LastModified, seeker)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	if _, err := io.Copy(w, object); err != nil {
+		log.Printf("Error streaming media %s: %v", objectKey, err)
+	}
+}
+
+// canAccessMessage reports whether the user took part in the message's
+// conversation: its sender, its receiver or a current member of its group.
+func canAccessMessage(r *http.Request, db *sql.DB, message *models.Message, userID int64) (bool, error) {
+	if message.SenderID == userID {
+		return true, nil
+	}
+	if message.ReceiverID != nil && *message.ReceiverID == userID {
+		return true, nil
+	}
+	if message.GroupID == nil {
+		return false, nil
+	}
+
+	_, err := repository.GetGroupMember(r.Context(), db, *message.GroupID, userID)
+	if errors.Is(err, repository.ErrNotGroupMember) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func deleteObjects(ctx context.Context, store storage.ObjectStorage, keys []string) {
+	for _, key := range keys {
+		if err := store.Delete(ctx, key); err != nil {
+			log.Printf("Error deleting orphaned upload %s: %v", key, err)
+		}
+	}
+}
+
+func writeUploadReadError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, "File exceeds the upload limit", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+}
+
+func newMediaResponse(media *models.Media) MediaResponse {
+	return MediaResponse{
+		UUID:        media.UUID.String(),
+		MediaType:   media.MediaType,
+		ContentType: media.ContentType,
+		SizeBytes:   media.SizeBytes,
+		Width:       media.Width,
+		Height:      media.Height,
+		CreatedAt:   media.CreatedAt,
+	}
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/storage"
+	"github.com/AndreaCasaluci/go-chat-app/utils"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+)
+
+// newUploadRequest builds a POST /media request whose "file" field claims
+// the given file name and content type but holds data.
+func newUploadRequest(t *testing.T, userUUID uuid.UUID, fileName, contentType string, data []byte) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, fileName))
+	header.Set("Content-Type", contentType)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		t.Fatalf("could not create multipart body: %v", err)
+	}
+	part.Write(data)
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/media", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return withUser(req, 1, userUUID)
+}
+
+// storedObjects lists the object keys the local storage holds for a user.
+func storedObjects(t *testing.T, userUUID uuid.UUID) []string {
+	t.Helper()
+
+	root := filepath.Join(utils.AppConfig.StorageDir, "media", userUUID.String())
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("could not list stored objects: %v", err)
+	}
+
+	var keys []string
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".meta") {
+			keys = append(keys, "media/"+userUUID.String()+"/"+entry.Name())
+		}
+	}
+	return keys
+}
+
+func encodePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 200, A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("could not encode PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestUploadMediaRejectsFileOverLimit(t *testing.T) {
+	previous := utils.AppConfig.MaxUploadMB
+	utils.AppConfig.MaxUploadMB = 1
+	t.Cleanup(func() { utils.AppConfig.MaxUploadMB = previous })
+
+	// A valid PNG header followed by padding, one byte past the limit.
+	data := append(encodePNG(t, 2, 2), make([]byte, 1<<20)...)
+	userUUID := uuid.New()
+
+	rec := httptest.NewRecorder()
+	UploadMedia(rec, newUploadRequest(t, userUUID, "large.png", "image/png", data))
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("UploadMedia returned %d, want %d: %s", rec.Code, http.StatusRequestEntityTooLarge, rec.Body.String())
+	}
+	if keys := storedObjects(t, userUUID); len(keys) != 0 {
+		t.Errorf("oversized upload was stored as %v", keys)
+	}
+}
+
+func TestUploadMediaRejectsSpoofedContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		fileName    string
+		contentType string
+		data        []byte
+	}{
+		{"script as PNG", "cat.png", "image/png", []byte("#!/bin/sh\nrm -rf ~\n")},
+		{"HTML as JPEG", "cat.jpg", "image/jpeg", []byte("<!DOCTYPE html><script>alert(document.cookie)</script>")},
+		{"PDF as MP4", "clip.mp4", "video/mp4", []byte("%PDF-1.7\n1 0 obj\n<<>>\nendobj\n")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userUUID := uuid.New()
+
+			rec := httptest.NewRecorder()
+			UploadMedia(rec, newUploadRequest(t, userUUID, tt.fileName, tt.contentType, tt.data))
+
+			if rec.Code != http.StatusUnsupportedMediaType {
+				t.Fatalf("UploadMedia returned %d, want %d: %s", rec.Code, http.StatusUnsupportedMediaType, rec.Body.String())
+			}
+			if keys := storedObjects(t, userUUID); len(keys) != 0 {
+				t.Errorf("rejected upload was stored as %v", keys)
+			}
+		})
+	}
+}
+
+func TestUploadMediaStoresSniffedContentType(t *testing.T) {
+	mock := newMockDb(t)
+	userUUID := uuid.New()
+	mediaUUID := uuid.New()
+
+	mock.ExpectQuery(`INSERT INTO media`).
+		WithArgs(sqlmock.AnyArg(), int64(1), sqlmock.AnyArg(), "image", "image/png", sqlmock.AnyArg(), 16, 16, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "uuid", "owner_id", "object_key", "media_type", "content_type", "size_bytes", "width", "height", "thumbnail_key", "created_at"}).
+			AddRow(1, mediaUUID.String(), 1, "media/key", "image", "image/png", 100, 16, 16, "media/key.thumb", time.Now()))
+
+	// The client claims a JPEG; the bytes say PNG, and the bytes win.
+	rec := httptest.NewRecorder()
+	UploadMedia(rec, newUploadRequest(t, userUUID, "photo.jpg", "image/jpeg", encodePNG(t, 16, 16)))
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("UploadMedia returned %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body.String())
+	}
+
+	var response MediaResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if response.ContentType != "image/png" {
+		t.Errorf("content type %q, want image/png", response.ContentType)
+	}
+
+	store, err := storage.GetStorage()
+	if err != nil {
+		t.Fatalf("could not get storage: %v", err)
+	}
+	keys := storedObjects(t, userUUID)
+	if len(keys) != 2 {
+		t.Fatalf("stored objects %v, want the image and its thumbnail", keys)
+	}
+	for _, key := range keys {
+		reader, info, err := store.Get(context.Background(), key)
+		if err != nil {
+			t.Fatalf("could not read stored object %s: %v", key, err)
+		}
+		data, _ := io.ReadAll(reader)
+		reader.Close()
+
+		if sniffed := http.DetectContentType(data); sniffed != info.ContentType {
+			t.Errorf("object %s stored as %s but holds %s", key, info.ContentType, sniffed)
+		}
+	}
+}
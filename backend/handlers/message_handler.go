@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/db"
+	"github.com/AndreaCasaluci/go-chat-app/models"
+	"github.com/AndreaCasaluci/go-chat-app/repository"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultMessagePageSize = 50
+	maxMessagePageSize     = 100
+)
+
+type MessageResponse struct {
+	UUID         uuid.UUID      `json:"uuid"`
+	SenderUUID   uuid.UUID      `json:"sender_uuid"`
+	ReceiverUUID *uuid.UUID     `json:"receiver_uuid,omitempty"`
+	GroupUUID    *uuid.UUID     `json:"group_uuid,omitempty"`
+	MessageText  string         `json:"message_text,omitempty"`
+	MediaType    string         `json:"media_type,omitempty"`
+	MediaURL     string         `json:"media_url,omitempty"` // Access-checked download endpoint
+	Media        *MediaResponse `json:"media,omitempty"`
+	CreatedAt    time.Time      `json:"created_at"`
+}
+
+// MessagePageResponse is a page of messages in chronological order.
+// OlderCursor and NewerCursor can be passed back as "before" and "after"
+// to continue paging in either direction.
+type MessagePageResponse struct {
+	Messages    []MessageResponse `json:"messages"`
+	OlderCursor string            `json:"older_cursor,omitempty"`
+	NewerCursor string            `json:"newer_cursor,omitempty"`
+	HasMore     bool              `json:"has_more"`
+}
+
+func GetConversationMessages(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	peerUUID, err := uuid.Parse(mux.Vars(r)["peer_uuid"])
+	if err != nil {
+		http.Error(w, "Invalid peer UUID", http.StatusBadRequest)
+		return
+	}
+
+	params, err := parseMessagePagination(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+
+	peer, err := repository.GetUserByUUID(ctx, db, peerUUID)
+	if err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error retrieving user: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	params.UserID = userID
+	params.PeerID = &peer.ID
+
+	writeMessagePage(w, r, db, params)
+}
+
+func GetGroupMessages(w http.ResponseWriter, r *http.Request) {
+	params, err := parseMessagePagination(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	group, member, ok := loadGroupForMember(w, r, db)
+	if !ok {
+		return
+	}
+
+	params.UserID = member.UserID
+	params.GroupID = &group.ID
+
+	writeMessagePage(w, r, db, params)
+}
+
+func parseMessagePagination(r *http.Request) (repository.ListMessagesParams, error) {
+	params := repository.ListMessagesParams{Limit: defaultMessagePageSize}
+	query := r.URL.Query()
+
+	if limit := query.Get("limit"); limit != "" {
+		parsedLimit, err := strconv.Atoi(limit)
+		if err != nil || parsedLimit < 1 || parsedLimit > maxMessagePageSize {
+			return params, fmt.Errorf("limit must be between 1 and %d", maxMessagePageSize)
+		}
+		params.Limit = parsedLimit
+	}
+
+	before, after := query.Get("before"), query.Get("after")
+	if before != "" && after != "" {
+		return params, fmt.Errorf("before and after cannot be combined")
+	}
+
+	if before != "" {
+		cursor, err := repository.DecodeMessageCursor(before)
+		if err != nil {
+			return params, err
+		}
+		params.Before = cursor
+	}
+
+	if after != "" {
+		cursor, err := repository.DecodeMessageCursor(after)
+		if err != nil {
+			return params, err
+		}
+		params.After = cursor
+	}
+
+	return params, nil
+}
+
+func writeMessagePage(w http.ResponseWriter, r *http.Request, db *sql.DB, params repository.ListMessagesParams) {
+	result, err := repository.ListMessages(r.Context(), db, params)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving messages: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := MessagePageResponse{
+		Messages: make([]MessageResponse, 0, len(result.Messages)),
+		HasMore:  result.HasMore,
+	}
+	for i := range result.Messages {
+		response.Messages = append(response.Messages, newMessageResponse(&result.Messages[i]))
+	}
+	if len(result.Messages) > 0 {
+		response.OlderCursor = repository.EncodeMessageCursor(&result.Messages[0])
+		response.NewerCursor = repository.EncodeMessageCursor(&result.Messages[len(result.Messages)-1])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func newMessageResponse(message *models.Message) MessageResponse {
+	response := MessageResponse{
+		UUID:         message.UUID,
+		SenderUUID:   message.SenderUUID,
+		ReceiverUUID: message.ReceiverUUID,
+		GroupUUID:    message.GroupUUID,
+		MessageText:  message.MessageText,
+		MediaType:    message.MediaType,
+		CreatedAt:    message.CreatedAt,
+	}
+	// The storage key in media_url stays internal; clients download through
+	// an endpoint that enforces conversation access control.
+	if message.Media != nil {
+		media := newMediaResponse(message.Media)
+		response.Media = &media
+		response.MediaURL = fmt.Sprintf("/messages/%s/media", message.UUID)
+		if message.Media.ThumbnailKey != "" {
+			response.Media.ThumbnailURL = response.MediaURL + "?variant=thumbnail"
+		}
+	}
+	return response
+}
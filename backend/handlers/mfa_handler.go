@@ -0,0 +1,356 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/db"
+	"github.com/AndreaCasaluci/go-chat-app/ratelimit"
+	"github.com/AndreaCasaluci/go-chat-app/repository"
+	"github.com/AndreaCasaluci/go-chat-app/utils"
+)
+
+const (
+	// How long the user has to enter a second factor after their password.
+	mfaPendingTTL = 5 * time.Minute
+
+	// Issuer shown next to the account in authenticator apps.
+	totpIssuer = "Go Chat App"
+
+	// Number of recovery codes handed out when two-factor is enabled.
+	recoveryCodeCount = 10
+)
+
+type EnrollTOTPRequest struct {
+	CurrentPassword *string `json:"current_password,omitempty" validate:"omitnil,max=72"`
+}
+
+type EnrollTOTPResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type ConfirmTOTPRequest struct {
+	Code string `json:"code" validate:"required,numeric,len=6"`
+}
+
+type ConfirmTOTPResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type DisableTOTPRequest struct {
+	CurrentPassword *string `json:"current_password,omitempty" validate:"omitnil,max=72"`
+	Code            string  `json:"code" validate:"required,max=32"`
+}
+
+type LoginMFARequest struct {
+	MFAToken string `json:"mfa_token" validate:"required"`
+	Code     string `json:"code" validate:"required,max=32"`
+}
+
+// EnrollTOTP starts two-factor enrollment by generating a secret for the
+// caller. It has no effect on login until confirmed with ConfirmTOTP, and can
+// be repeated to start over with a new secret.
+func EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var enrollReq EnrollTOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&enrollReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.ValidateStruct(enrollReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if !checkRecentAuth(w, r, db, enrollReq.CurrentPassword) {
+		return
+	}
+
+	ctx := r.Context()
+
+	user, err := repository.GetUserByID(ctx, db, userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving user: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error generating secret: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := repository.SetPendingTOTPSecret(ctx, db, userID, secret); err != nil {
+		if errors.Is(err, repository.ErrTOTPAlreadyEnabled) {
+			http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error storing secret: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EnrollTOTPResponse{
+		Secret:          secret,
+		ProvisioningURI: utils.TOTPProvisioningURI(totpIssuer, user.Email, secret),
+	})
+}
+
+// ConfirmTOTP enables two-factor authentication once the caller proves their
+// authenticator app produces valid codes, and returns their recovery codes.
+// The codes are only ever shown here; just their hashes are stored.
+func ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var confirmReq ConfirmTOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&confirmReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.ValidateStruct(confirmReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+
+	state, err := repository.GetTOTPState(ctx, db, userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving two-factor settings: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if state.Enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if state.Secret == "" {
+		http.Error(w, "Two-factor enrollment has not been started", http.StatusConflict)
+		return
+	}
+
+	step, valid := utils.ValidateTOTP(state.Secret, confirmReq.Code, time.Now())
+	if !valid {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	recoveryCodes := make([]string, 0, recoveryCodeCount)
+	codeHashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := utils.GenerateRecoveryCode()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error generating recovery codes: %v", err), http.StatusInternalServerError)
+			return
+		}
+		recoveryCodes = append(recoveryCodes, code)
+		codeHashes = append(codeHashes, utils.HashToken(utils.NormalizeRecoveryCode(code)))
+	}
+
+	if err := repository.EnableTOTP(ctx, db, userID, step, codeHashes); err != nil {
+		if errors.Is(err, repository.ErrTOTPAlreadyEnabled) || errors.Is(err, repository.ErrTOTPNotEnrolled) {
+			http.Error(w, "Two-factor enrollment is no longer pending", http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error enabling two-factor authentication: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ConfirmTOTPResponse{RecoveryCodes: recoveryCodes})
+}
+
+// DisableTOTP turns two-factor authentication off. Besides step-up
+// authentication it requires a current code or a recovery code, so that a
+// stolen password alone cannot remove the second factor.
+func DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var disableReq DisableTOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&disableReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.ValidateStruct(disableReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if !checkRecentAuth(w, r, db, disableReq.CurrentPassword) {
+		return
+	}
+
+	ctx := r.Context()
+
+	state, err := repository.GetTOTPState(ctx, db, userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving two-factor settings: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !state.Enabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+		return
+	}
+
+	valid, err := verifySecondFactor(ctx, db, userID, state, disableReq.Code)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error verifying code: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.Error(w, "Invalid code", http.StatusForbidden)
+		return
+	}
+
+	if err := repository.DisableTOTP(ctx, db, userID); err != nil {
+		http.Error(w, fmt.Sprintf("Error disabling two-factor authentication: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LoginMFA completes a login started by LoginUser for a user with two-factor
+// authentication, exchanging the MFA token and a code for real tokens.
+func LoginMFA(w http.ResponseWriter, r *http.Request) {
+	var loginReq LoginMFARequest
+
+	if err := json.NewDecoder(r.Body).Decode(&loginReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.ValidateStruct(loginReq); err != nil {
+		http.Error(w, fmt.Sprintf("Validation error: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	claims, err := utils.ValidateMFAPendingToken(loginReq.MFAToken)
+	if err != nil {
+		http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+
+	userUUID, err := claims.UserUUID()
+	if err != nil {
+		http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	limiter, err := ratelimit.GetLoginLimiter()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not get login limiter: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+	mfaKey := mfaLoginKey(userUUID)
+
+	retryAfter, err := reserveLoginAttempt(ctx, limiter, mfaKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking login attempts: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if retryAfter > 0 {
+		writeLoginLocked(w, retryAfter)
+		return
+	}
+
+	user, err := repository.GetUserByUUID(ctx, db, userUUID)
+	if err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+			return
+		}
+		releaseLoginAttempt(ctx, limiter, mfaKey)
+		http.Error(w, fmt.Sprintf("Error retrieving user: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	state, err := repository.GetTOTPState(ctx, db, user.ID)
+	if err != nil {
+		releaseLoginAttempt(ctx, limiter, mfaKey)
+		http.Error(w, fmt.Sprintf("Error retrieving two-factor settings: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	valid := false
+	if state.Enabled {
+		valid, err = verifySecondFactor(ctx, db, user.ID, state, loginReq.Code)
+		if err != nil {
+			releaseLoginAttempt(ctx, limiter, mfaKey)
+			http.Error(w, fmt.Sprintf("Error verifying code: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	if !valid {
+		http.Error(w, "Authentication failed: invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	resetLoginFailures(ctx, limiter, mfaKey)
+
+	response, err := issueTokens(r, db, user)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error generating tokens: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// verifySecondFactor accepts either a TOTP code that has not been used yet or
+// an unused recovery code, consuming it.
+func verifySecondFactor(ctx context.Context, db *sql.DB, userID int64, state *repository.TOTPState, code string) (bool, error) {
+	if step, valid := utils.ValidateTOTP(state.Secret, code, time.Now()); valid {
+		return repository.UseTOTPStep(ctx, db, userID, step)
+	}
+
+	return repository.UseRecoveryCode(ctx, db, userID, utils.HashToken(utils.NormalizeRecoveryCode(code)))
+}
@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/db"
+	"github.com/AndreaCasaluci/go-chat-app/repository"
+	"github.com/AndreaCasaluci/go-chat-app/sso"
+	"github.com/AndreaCasaluci/go-chat-app/utils"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// Time a user has to complete the login at the issuer.
+	oidcFlowTTL = 10 * time.Minute
+
+	// Cookie holding the flow token between the redirect and the callback.
+	oidcFlowCookie = "oidc_flow"
+	oidcFlowPath   = "/auth/oidc"
+
+	// Usernames derived from an external identity leave room for the
+	// suffix added when they are taken.
+	maxDerivedUsernameLength = 15
+)
+
+var invalidUsernameChars = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// OIDCLogin starts a login with the configured OpenID Connect provider and
+// redirects the browser to it. The state, nonce and PKCE verifier of the
+// attempt are kept in a signed, HttpOnly cookie for OIDCCallback.
+func OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	provider, err := sso.GetProvider()
+	if err != nil {
+		if errors.Is(err, sso.ErrNotConfigured) {
+			http.Error(w, "OIDC login is not available", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Could not reach the identity provider: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	state, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error generating state: %v", err), http.StatusInternalServerError)
+		return
+	}
+	nonce, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error generating nonce: %v", err), http.StatusInternalServerError)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	flowToken, err := utils.GenerateOIDCFlowToken(state, nonce, verifier, oidcFlowTTL)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error generating login token: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcFlowCookie,
+		Value:    flowToken,
+		Path:     oidcFlowPath,
+		MaxAge:   int(oidcFlowTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   secureCookies(r),
+		// Lax, so that the cookie comes along on the top-level redirect back
+		// from the issuer.
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, provider.AuthCodeURL(state, nonce, verifier), http.StatusFound)
+}
+
+// OIDCCallback completes a login started by OIDCLogin. The external identity
+// is linked to a local user, see repository.LoginWithExternalIdentity, who
+// then gets the same response as from LoginUser.
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	provider, err := sso.GetProvider()
+	if err != nil {
+		if errors.Is(err, sso.ErrNotConfigured) {
+			http.Error(w, "OIDC login is not available", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Could not reach the identity provider: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcFlowCookie)
+	if err != nil {
+		http.Error(w, "Missing or expired login attempt", http.StatusBadRequest)
+		return
+	}
+
+	// The attempt is single use, whatever its outcome.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcFlowCookie,
+		Path:     oidcFlowPath,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	flow, err := utils.ValidateOIDCFlowToken(cookie.Value)
+	if err != nil {
+		http.Error(w, "Missing or expired login attempt", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(flow.State)) != 1 {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+
+	if errorCode := query.Get("error"); errorCode != "" {
+		http.Error(w, fmt.Sprintf("Authentication failed: %s", errorCode), http.StatusUnauthorized)
+		return
+	}
+
+	code := query.Get("code")
+	if code == "" {
+		http.Error(w, "Missing authorization code", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+
+	identity, err := provider.Exchange(ctx, code, flow.Nonce, flow.Verifier)
+	if err != nil {
+		log.Printf("OIDC login failed: %v", err)
+		http.Error(w, "Authentication failed: could not verify the identity provider response", http.StatusUnauthorized)
+		return
+	}
+
+	if identity.Email == "" {
+		http.Error(w, "The identity provider did not share an email address", http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// New accounts get a password nobody knows; the user can set one with
+	// the password reset flow to log in without the provider as well.
+	unusablePassword, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error generating password: %v", err), http.StatusInternalServerError)
+		return
+	}
+	hashedPassword, err := utils.HashPassword(unusablePassword)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error hashing password: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	result, err := repository.LoginWithExternalIdentity(ctx, db, repository.ExternalIdentityParams{
+		Provider:       provider.Name,
+		Subject:        identity.Subject,
+		Email:          identity.Email,
+		EmailVerified:  identity.EmailVerified,
+		Username:       derivedUsername(identity),
+		HashedPassword: *hashedPassword,
+	})
+	if err != nil {
+		if errors.Is(err, repository.ErrIdentityEmailConflict) {
+			// Linking needs a verified email on both sides; only the local
+			// one is something the user can still fix.
+			if identity.EmailVerified {
+				http.Error(w, "An account with this email already exists; log in with its password and verify its email address, then sign in with the provider again to link it", http.StatusConflict)
+				return
+			}
+			http.Error(w, "An account with this email already exists and the identity provider has not verified the address, so it cannot be linked; log in with its password instead", http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error logging in: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	user := result.User
+	if result.Created && !user.Verified {
+		sendVerificationEmailAsync(db, user)
+	}
+
+	if user.TOTPEnabled {
+		writeMFARequired(w, user)
+		return
+	}
+
+	response, err := issueTokens(r, db, user)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error generating tokens: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// derivedUsername turns the preferred username of an identity, or the local
+// part of its email, into a valid username.
+func derivedUsername(identity *sso.Identity) string {
+	name := identity.PreferredUsername
+	if name == "" {
+		name, _, _ = strings.Cut(identity.Email, "@")
+	}
+
+	name = strings.Trim(invalidUsernameChars.ReplaceAllString(name, "_"), "_")
+	if len(name) > maxDerivedUsernameLength {
+		name = name[:maxDerivedUsernameLength]
+	}
+	if len(name) < 3 {
+		name = "user"
+	}
+	return name
+}
+
+// secureCookies reports whether cookies should be restricted to HTTPS,
+// which is the case whenever the app is served over it.
+func secureCookies(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	config, err := utils.GetConfig()
+	return err == nil && strings.HasPrefix(config.AppBaseURL, "https://")
+}
@@ -0,0 +1,364 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/utils"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	fakeIssuerClientID     = "go-chat-app-test"
+	fakeIssuerClientSecret = "go-chat-app-test-secret"
+	fakeIssuerKeyID        = "fake-issuer-key"
+)
+
+// oidcIssuer is the issuer OIDC_ISSUER_URL points at during the tests.
+var oidcIssuer *fakeIssuer
+
+// fakeIssuer is an in-process OpenID Connect issuer serving discovery, JWKS
+// and the token endpoint. Tests play the part of its consent page with
+// authorize, which hands out a code bound to the PKCE challenge and nonce of
+// an auth code URL.
+type fakeIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]fakeAuthorization
+}
+
+type fakeAuthorization struct {
+	challenge string
+	nonce     string
+	claims    fakeIDClaims
+}
+
+// fakeIDClaims are what the issuer asserts about the user who consented.
+type fakeIDClaims struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+}
+
+func newFakeIssuer() *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	issuer := &fakeIssuer{key: key, codes: make(map[string]fakeAuthorization)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("/jwks", issuer.jwks)
+	mux.HandleFunc("/token", issuer.token)
+	issuer.server = httptest.NewServer(mux)
+	return issuer
+}
+
+func (i *fakeIssuer) URL() string {
+	return i.server.URL
+}
+
+func (i *fakeIssuer) Close() {
+	i.server.Close()
+}
+
+// authorize checks the auth code URL the way the issuer's consent page would
+// and returns the code it redirects back with. A non-empty nonce replaces
+// the one in the URL.
+func (i *fakeIssuer) authorize(t *testing.T, authURL *url.URL, claims fakeIDClaims, nonce string) string {
+	t.Helper()
+
+	query := authURL.Query()
+	if query.Get("client_id") != fakeIssuerClientID || query.Get("response_type") != "code" {
+		t.Fatalf("unexpected authorization request: %s", authURL)
+	}
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("authorization request without S256 PKCE challenge: %s", authURL)
+	}
+	if nonce == "" {
+		nonce = query.Get("nonce")
+	}
+
+	code := uuid.NewString()
+	i.mu.Lock()
+	i.codes[code] = fakeAuthorization{challenge: query.Get("code_challenge"), nonce: nonce, claims: claims}
+	i.mu.Unlock()
+	return code
+}
+
+func (i *fakeIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                i.URL(),
+		"authorization_endpoint":                i.URL() + "/authorize",
+		"token_endpoint":                        i.URL() + "/token",
+		"jwks_uri":                              i.URL() + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (i *fakeIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": fakeIssuerKeyID,
+			"n":   base64.RawURLEncoding.EncodeToString(i.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(i.key.E)).Bytes()),
+		}},
+	})
+}
+
+// token redeems a code once, and only with the verifier matching its PKCE
+// challenge.
+func (i *fakeIssuer) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if clientID != fakeIssuerClientID || clientSecret != fakeIssuerClientSecret {
+		writeTokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		writeTokenError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	i.mu.Lock()
+	authorization, ok := i.codes[r.PostFormValue("code")]
+	delete(i.codes, r.PostFormValue("code"))
+	i.mu.Unlock()
+	if !ok {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	digest := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(digest[:]) != authorization.challenge {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                i.URL(),
+		"sub":                authorization.claims.Subject,
+		"aud":                fakeIssuerClientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Minute).Unix(),
+		"nonce":              authorization.nonce,
+		"email":              authorization.claims.Email,
+		"email_verified":     authorization.claims.EmailVerified,
+		"preferred_username": authorization.claims.PreferredUsername,
+	})
+	idToken.Header["kid"] = fakeIssuerKeyID
+	signed, err := idToken.SignedString(i.key)
+	if err != nil {
+		writeTokenError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": uuid.NewString(),
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     signed,
+	})
+}
+
+func writeTokenError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+// startOIDCLogin runs OIDCLogin and returns the flow cookie it set and the
+// auth code URL it redirected to.
+func startOIDCLogin(t *testing.T) (*http.Cookie, *url.URL) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	OIDCLogin(rec, httptest.NewRequest(http.MethodGet, "/auth/oidc/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("OIDCLogin returned %d: %s", rec.Code, rec.Body.String())
+	}
+
+	authURL, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("invalid redirect: %v", err)
+	}
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == oidcFlowCookie {
+			return cookie, authURL
+		}
+	}
+	t.Fatal("OIDCLogin did not set the flow cookie")
+	return nil, nil
+}
+
+func oidcCallback(cookie *http.Cookie, state, code string) *httptest.ResponseRecorder {
+	query := url.Values{"state": {state}, "code": {code}}
+	req := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?"+query.Encode(), nil)
+	req.AddCookie(cookie)
+
+	rec := httptest.NewRecorder()
+	OIDCCallback(rec, req)
+	return rec
+}
+
+var userColumns = []string{"id", "uuid", "username", "email", "verified", "totp_enabled", "created_at", "updated_at"}
+
+// expectIdentityLookup expects the transaction of LoginWithExternalIdentity
+// up to the lookup of a local account by email, which returns existing.
+func expectIdentityLookup(mock sqlmock.Sqlmock, existing *sqlmock.Rows) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`JOIN user_identities i ON i.user_id = u.id\s+WHERE i.provider = \$1 AND i.subject = \$2`).
+		WithArgs("fake", "subject-1").
+		WillReturnRows(sqlmock.NewRows(userColumns))
+	mock.ExpectQuery(`WHERE LOWER\(u.email\) = LOWER\(\$1\) FOR UPDATE`).
+		WithArgs("alice@example.com").
+		WillReturnRows(existing)
+}
+
+func TestOIDCCallbackLinksVerifiedUser(t *testing.T) {
+	mock := newMockDb(t)
+
+	userUUID := uuid.New()
+	now := time.Now().UTC()
+	expectIdentityLookup(mock, sqlmock.NewRows(userColumns).
+		AddRow(42, userUUID.String(), "alice", "alice@example.com", true, false, now, now))
+	mock.ExpectExec(`INSERT INTO user_identities`).
+		WithArgs(int64(42), "fake", "subject-1", "alice@example.com", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO sessions`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "uuid", "user_id", "user_agent", "ip_address", "expires_at", "created_at", "last_seen_at", "revoked_at"}).
+			AddRow(7, uuid.NewString(), 42, nil, nil, now.Add(time.Hour), now, now, nil))
+	mock.ExpectExec(`INSERT INTO refresh_tokens`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	cookie, authURL := startOIDCLogin(t)
+	code := oidcIssuer.authorize(t, authURL, fakeIDClaims{Subject: "subject-1", Email: "alice@example.com", EmailVerified: true}, "")
+
+	rec := oidcCallback(cookie, authURL.Query().Get("state"), code)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("OIDCCallback returned %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var response LoginResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	claims, err := utils.ValidateToken(response.Token)
+	if err != nil {
+		t.Fatalf("invalid access token: %v", err)
+	}
+	if claims.UserUUID != userUUID {
+		t.Errorf("access token issued to %s, want the linked user %s", claims.UserUUID, userUUID)
+	}
+	if response.RefreshToken == "" {
+		t.Error("no refresh token issued")
+	}
+}
+
+func TestOIDCCallbackRejectsEmailConflict(t *testing.T) {
+	tests := []struct {
+		name          string
+		emailVerified bool
+		localVerified bool
+		message       string
+	}{
+		{"local email unverified", true, false, "verify its email address"},
+		{"issuer email unverified", false, true, "has not verified the address"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockDb(t)
+
+			now := time.Now().UTC()
+			expectIdentityLookup(mock, sqlmock.NewRows(userColumns).
+				AddRow(42, uuid.NewString(), "alice", "alice@example.com", tt.localVerified, false, now, now))
+			mock.ExpectRollback()
+
+			cookie, authURL := startOIDCLogin(t)
+			code := oidcIssuer.authorize(t, authURL, fakeIDClaims{Subject: "subject-1", Email: "alice@example.com", EmailVerified: tt.emailVerified}, "")
+
+			rec := oidcCallback(cookie, authURL.Query().Get("state"), code)
+			if rec.Code != http.StatusConflict {
+				t.Fatalf("OIDCCallback returned %d, want %d: %s", rec.Code, http.StatusConflict, rec.Body.String())
+			}
+			if !strings.Contains(rec.Body.String(), tt.message) {
+				t.Errorf("conflict message %q does not mention %q", rec.Body.String(), tt.message)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackRejectsStateMismatch(t *testing.T) {
+
+	cookie, authURL := startOIDCLogin(t)
+	code := oidcIssuer.authorize(t, authURL, fakeIDClaims{Subject: "subject-1", Email: "alice@example.com", EmailVerified: true}, "")
+
+	rec := oidcCallback(cookie, "forged-state", code)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("OIDCCallback returned %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body.String())
+	}
+}
+
+func TestOIDCCallbackRejectsNonceMismatch(t *testing.T) {
+
+	cookie, authURL := startOIDCLogin(t)
+	code := oidcIssuer.authorize(t, authURL, fakeIDClaims{Subject: "subject-1", Email: "alice@example.com", EmailVerified: true}, "replayed-nonce")
+
+	rec := oidcCallback(cookie, authURL.Query().Get("state"), code)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("OIDCCallback returned %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body.String())
+	}
+}
+
+func TestOIDCCallbackRejectsWrongVerifier(t *testing.T) {
+
+	cookie, authURL := startOIDCLogin(t)
+	code := oidcIssuer.authorize(t, authURL, fakeIDClaims{Subject: "subject-1", Email: "alice@example.com", EmailVerified: true}, "")
+
+	// A flow token for the same state and nonce, but another verifier, as if
+	// the code had been intercepted and redeemed from a different attempt.
+	forged, err := utils.GenerateOIDCFlowToken(authURL.Query().Get("state"), authURL.Query().Get("nonce"), "another-verifier-another-verifier-0123456789", oidcFlowTTL)
+	if err != nil {
+		t.Fatalf("could not generate flow token: %v", err)
+	}
+	cookie.Value = forged
+
+	rec := oidcCallback(cookie, authURL.Query().Get("state"), code)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("OIDCCallback returned %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body.String())
+	}
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/db"
+	"github.com/AndreaCasaluci/go-chat-app/mailer"
+	"github.com/AndreaCasaluci/go-chat-app/repository"
+	"github.com/AndreaCasaluci/go-chat-app/utils"
+)
+
+const (
+	// How long a password reset link stays valid.
+	passwordResetTTL = time.Hour
+
+	// Minimum time between two password reset emails to the same user.
+	passwordResetInterval = time.Minute
+)
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,min=8,max=32"`
+}
+
+type ForgotPasswordResponse struct {
+	Message string `json:"message"`
+}
+
+// ForgotPassword emails a password reset link to the given address if it
+// belongs to a user. The response is the same whether or not it does, and the
+// lookup and delivery happen after responding, so neither the body nor the
+// timing reveals which addresses are registered.
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var forgotReq ForgotPasswordRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&forgotReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.ValidateStruct(forgotReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), emailSendTimeout)
+		defer cancel()
+
+		if err := sendPasswordResetEmail(ctx, forgotReq.Email); err != nil {
+			log.Printf("Error sending password reset email: %v", err)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(ForgotPasswordResponse{
+		Message: "If an account exists for this email, a password reset link has been sent to it",
+	})
+}
+
+// ResetPassword sets a new password using the token from a reset email. The
+// token works once, and every session of the user is revoked.
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var resetReq ResetPasswordRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&resetReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.ValidateStruct(resetReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, err := utils.HashPassword(resetReq.Password)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error hashing password: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+
+	result, err := repository.ResetPassword(ctx, db, repository.ResetPasswordParams{
+		TokenHash:      utils.HashToken(resetReq.Token),
+		HashedPassword: *hashedPassword,
+	})
+	if err != nil {
+		if errors.Is(err, repository.ErrPasswordResetTokenInvalid) {
+			http.Error(w, "Invalid or expired password reset token", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error resetting password: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := invalidateSessionTokens(ctx, db, result.RevokedSessions...); err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func sendPasswordResetEmail(ctx context.Context, email string) error {
+	db, err := database.GetDb()
+	if err != nil {
+		return err
+	}
+
+	user, err := repository.GetUserByEmail(ctx, db, email)
+	if err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	m, err := mailer.GetMailer()
+	if err != nil {
+		return err
+	}
+
+	token, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	err = repository.CreatePasswordResetToken(ctx, db, repository.CreatePasswordResetTokenParams{
+		UserID:      user.ID,
+		TokenHash:   utils.HashToken(token),
+		ExpiresAt:   time.Now().Add(passwordResetTTL),
+		MinInterval: passwordResetInterval,
+	})
+	if err != nil {
+		if errors.Is(err, repository.ErrPasswordResetThrottled) {
+			return nil
+		}
+		return err
+	}
+
+	link, err := appLink("/password/reset", token)
+	if err != nil {
+		return err
+	}
+
+	return m.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nsomeone asked to reset the password of your account. To choose a new one, open the link below:\n\n%s\n\n"+
+			"The link expires in %d minutes and can be used once. If you did not ask for this, you can ignore this email.\n",
+			user.Username, link, int(passwordResetTTL.Minutes())),
+	})
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/db"
+	"github.com/AndreaCasaluci/go-chat-app/models"
+	"github.com/AndreaCasaluci/go-chat-app/repository"
+	"github.com/AndreaCasaluci/go-chat-app/utils"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// CreatePersonalAccessTokenRequest mints a token; minting one is a sensitive
+// operation and requires step-up authentication, see checkRecentAuth.
+type CreatePersonalAccessTokenRequest struct {
+	Name            string   `json:"name" validate:"required,min=1,max=100"`
+	Scopes          []string `json:"scopes" validate:"required,min=1,unique,dive,oneof=messages:read messages:write groups:read groups:write users:read"`
+	ExpiresInDays   *int     `json:"expires_in_days" validate:"omitnil,min=1,max=365"`
+	CurrentPassword *string  `json:"current_password,omitempty" validate:"omitnil,max=72"`
+}
+
+type PersonalAccessTokenResponse struct {
+	UUID       string     `json:"uuid"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// CreatedPersonalAccessTokenResponse is the only response that ever carries
+// the token itself.
+type CreatedPersonalAccessTokenResponse struct {
+	PersonalAccessTokenResponse
+	Token string `json:"token"`
+}
+
+// CreatePersonalAccessToken mints a named, scoped token for the caller. The
+// token is returned once and only its hash is stored.
+func CreatePersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var tokenReq CreatePersonalAccessTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&tokenReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.ValidateStruct(tokenReq); err != nil {
+		http.Error(w, fmt.Sprintf("Validation error: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if !checkRecentAuth(w, r, db, tokenReq.CurrentPassword) {
+		return
+	}
+
+	token, err := utils.GeneratePersonalAccessToken()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error generating token: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	var expiresAt *time.Time
+	if tokenReq.ExpiresInDays != nil {
+		expiry := time.Now().UTC().AddDate(0, 0, *tokenReq.ExpiresInDays)
+		expiresAt = &expiry
+	}
+
+	created, err := repository.CreatePersonalAccessToken(r.Context(), db, repository.CreatePersonalAccessTokenParams{
+		UserID:    userID,
+		Name:      tokenReq.Name,
+		TokenHash: utils.HashToken(token),
+		Scopes:    tokenReq.Scopes,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating token: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreatedPersonalAccessTokenResponse{
+		PersonalAccessTokenResponse: newPersonalAccessTokenResponse(created),
+		Token:                       token,
+	})
+}
+
+// ListPersonalAccessTokens returns the caller's tokens that have not been
+// revoked, without the tokens themselves.
+func ListPersonalAccessTokens(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := repository.ListPersonalAccessTokens(r.Context(), db, userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving tokens: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]PersonalAccessTokenResponse, 0, len(tokens))
+	for i := range tokens {
+		response = append(response, newPersonalAccessTokenResponse(&tokens[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// RevokePersonalAccessToken revokes one of the caller's tokens and closes the
+// WebSocket connections opened with it.
+func RevokePersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tokenUUID, err := uuid.Parse(mux.Vars(r)["uuid"])
+	if err != nil {
+		http.Error(w, "Invalid token UUID", http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+
+	token, err := repository.GetPersonalAccessTokenByUUID(ctx, db, tokenUUID)
+	if err != nil {
+		if errors.Is(err, repository.ErrPersonalAccessTokenNotFound) {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error retrieving token: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if token.UserID != userID || token.RevokedAt != nil {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+
+	if err := repository.RevokePersonalAccessToken(ctx, db, token.UUID); err != nil {
+		if errors.Is(err, repository.ErrPersonalAccessTokenNotFound) {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error revoking token: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	GetHub().CloseSession(token.UUID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newPersonalAccessTokenResponse(token *models.PersonalAccessToken) PersonalAccessTokenResponse {
+	return PersonalAccessTokenResponse{
+		UUID:       token.UUID.String(),
+		Name:       token.Name,
+		Scopes:     token.Scopes,
+		ExpiresAt:  token.ExpiresAt,
+		LastUsedAt: token.LastUsedAt,
+		CreatedAt:  token.CreatedAt,
+	}
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/db"
+	"github.com/AndreaCasaluci/go-chat-app/models"
+	"github.com/AndreaCasaluci/go-chat-app/repository"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+type SessionResponse struct {
+	UUID       string    `json:"uuid"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	Current    bool      `json:"current"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type RevokeSessionsResponse struct {
+	Revoked int `json:"revoked"`
+}
+
+// ListSessions returns the active sessions of the caller, one per device
+// they are logged in on, flagging the one the request was made with.
+func ListSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	currentSessionID, _ := r.Context().Value("session_id").(uuid.UUID)
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	sessions, err := repository.ListActiveSessions(r.Context(), db, userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]SessionResponse, 0, len(sessions))
+	for i := range sessions {
+		response = append(response, newSessionResponse(&sessions[i], currentSessionID))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// RevokeSession logs the caller out of one of their sessions. Revoking the
+// current session is equivalent to logging out.
+func RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sessionUUID, err := uuid.Parse(mux.Vars(r)["uuid"])
+	if err != nil {
+		http.Error(w, "Invalid session UUID", http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+
+	session, err := repository.GetSessionByUUID(ctx, db, sessionUUID)
+	if err != nil {
+		if errors.Is(err, repository.ErrSessionNotFound) {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error retrieving session: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if session.UserID != userID || session.RevokedAt != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if err := revokeSession(ctx, db, session.UUID); err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking session: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeOtherSessions logs the caller out of every device except the one the
+// request was made with.
+func RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	currentSessionID, _ := r.Context().Value("session_id").(uuid.UUID)
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	revoked, err := revokeOtherSessions(r.Context(), db, userID, currentSessionID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RevokeSessionsResponse{Revoked: revoked})
+}
+
+// revokeOtherSessions ends every session of the user except keep and returns
+// how many were revoked.
+func revokeOtherSessions(ctx context.Context, db *sql.DB, userID int64, keep uuid.UUID) (int, error) {
+	sessionIDs, err := repository.RevokeOtherSessions(ctx, db, userID, keep)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := invalidateSessionTokens(ctx, db, sessionIDs...); err != nil {
+		return 0, err
+	}
+	return len(sessionIDs), nil
+}
+
+func newSessionResponse(session *models.Session, currentSessionID uuid.UUID) SessionResponse {
+	return SessionResponse{
+		UUID:       session.UUID.String(),
+		UserAgent:  session.UserAgent,
+		IPAddress:  session.IPAddress,
+		Current:    session.UUID == currentSessionID,
+		CreatedAt:  session.CreatedAt,
+		LastSeenAt: session.LastSeenAt,
+		ExpiresAt:  session.ExpiresAt,
+	}
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/AndreaCasaluci/go-chat-app/db"
+	"github.com/AndreaCasaluci/go-chat-app/models"
+	"github.com/AndreaCasaluci/go-chat-app/repository"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// BlockUser blocks a user for the caller: neither finds the other in search
+// any more and direct messages between them are refused.
+func BlockUser(w http.ResponseWriter, r *http.Request) {
+	userID, target, ok := loadBlockTarget(w, r)
+	if !ok {
+		return
+	}
+
+	if target.ID == userID {
+		http.Error(w, "You cannot block yourself", http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := repository.BlockUser(r.Context(), db, userID, target.ID); err != nil {
+		http.Error(w, fmt.Sprintf("Error blocking user: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func UnblockUser(w http.ResponseWriter, r *http.Request) {
+	userID, target, ok := loadBlockTarget(w, r)
+	if !ok {
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := repository.UnblockUser(r.Context(), db, userID, target.ID); err != nil {
+		if errors.Is(err, repository.ErrBlockNotFound) {
+			http.Error(w, "User is not blocked", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error unblocking user: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListBlockedUsers returns the users the caller blocked, most recent first.
+func ListBlockedUsers(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	users, err := repository.ListBlockedUsers(r.Context(), db, userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving blocked users: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]PublicUserResponse, 0, len(users))
+	for i := range users {
+		response = append(response, newPublicUserResponse(&users[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// loadBlockTarget resolves the caller and the user named in the path. On
+// failure it writes the error response and returns false.
+func loadBlockTarget(w http.ResponseWriter, r *http.Request) (int64, *models.User, bool) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return 0, nil, false
+	}
+
+	targetUUID, err := uuid.Parse(mux.Vars(r)["uuid"])
+	if err != nil {
+		http.Error(w, "Invalid user UUID", http.StatusBadRequest)
+		return 0, nil, false
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return 0, nil, false
+	}
+
+	target, err := repository.GetUserByUUID(r.Context(), db, targetUUID)
+	if err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return 0, nil, false
+		}
+		http.Error(w, fmt.Sprintf("Error retrieving user: %v", err), http.StatusInternalServerError)
+		return 0, nil, false
+	}
+
+	return userID, target, true
+}
@@ -2,13 +2,17 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/AndreaCasaluci/go-chat-app/db"
+	"github.com/AndreaCasaluci/go-chat-app/models"
 	"github.com/AndreaCasaluci/go-chat-app/repository"
 	"github.com/AndreaCasaluci/go-chat-app/utils"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,20 +20,54 @@ type UserResponse struct {
 	UUID      string    `json:"uuid"`
 	Username  string    `json:"username"`
 	Email     string    `json:"email"`
+	Verified  bool      `json:"verified"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+const (
+	defaultUserSearchLimit = 20
+	maxUserSearchLimit     = 50
+	// Searches page no further than this many results; a longer query
+	// narrows them down better.
+	maxUserSearchResults = 500
+	maxUserSearchLength  = 100
+)
+
+// UserSearchResponse is a page of search matches, best first. NextCursor can
+// be passed back as "cursor" to get the next page.
+type UserSearchResponse struct {
+	Users      []PublicUserResponse `json:"users"`
+	NextCursor string               `json:"next_cursor,omitempty"`
+	HasMore    bool                 `json:"has_more"`
+}
+
+// PublicUserResponse is what any user may see of another.
+type PublicUserResponse struct {
+	UUID      string    `json:"uuid"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BatchGetUsersRequest lists the users to resolve, at most 100 at a time.
+type BatchGetUsersRequest struct {
+	UUIDs []string `json:"uuids" validate:"required,min=1,max=100,dive,uuid"`
+}
+
 type RegisterUserRequest struct {
 	Username string `json:"username" validate:"required,min=3,max=20,usernamechars"`
 	Email    string `json:"email" validate:"required,email"`
 	Password string `json:"password" validate:"required,min=8,max=32"`
 }
 
+// UpdateUserRequest applies the rules of RegisterUserRequest to the fields
+// that are present. Changing the email or password also requires step-up
+// authentication, see checkRecentAuth.
 type UpdateUserRequest struct {
-	Username *string `json:"username"`
-	Email    *string `json:"email,omitempty"`
-	Password *string `json:"password,omitempty"`
+	Username        *string `json:"username" validate:"omitnil,min=3,max=20,usernamechars"`
+	Email           *string `json:"email,omitempty" validate:"omitnil,email"`
+	Password        *string `json:"password,omitempty" validate:"omitnil,min=8,max=32"`
+	CurrentPassword *string `json:"current_password,omitempty" validate:"omitnil,max=72"`
 }
 
 func RegisterUser(w http.ResponseWriter, r *http.Request) {
@@ -70,23 +108,17 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := repository.CreateUser(ctx, db, repository.CreateUserParams{userReq.Username, userReq.Email, *hashedPassword})
+	user, err := repository.CreateUser(ctx, db, repository.CreateUserParams{Username: userReq.Username, Email: userReq.Email, HashedPassword: *hashedPassword})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error creating user: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	response := UserResponse{
-		UUID:      user.UUID.String(),
-		Username:  user.Username,
-		Email:     user.Email,
-		CreatedAt: user.CreatedAt,
-		UpdatedAt: user.UpdatedAt,
-	}
+	sendVerificationEmailAsync(db, user)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(newUserResponse(user))
 }
 
 func UpdateUser(w http.ResponseWriter, r *http.Request) {
@@ -110,6 +142,11 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := utils.ValidateStruct(userReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
 	db, err := database.GetDb()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
@@ -118,6 +155,12 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 
 	ctx := r.Context()
 
+	if userReq.Email != nil || userReq.Password != nil {
+		if !checkRecentAuth(w, r, db, userReq.CurrentPassword) {
+			return
+		}
+	}
+
 	isExistResult := repository.IsUserExists(ctx, db, userReq.Username, userReq.Email)
 	if isExistResult.Err != nil {
 		http.Error(w, fmt.Sprintf("Error checking user existence: %v", err), http.StatusInternalServerError)
@@ -129,21 +172,231 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	updatedUser, err := repository.UpdateUser(ctx, db, repository.UpdateUserParams{&claimUUID, userReq.Username, userReq.Email, userReq.Password})
+	updatedUser, err := repository.UpdateUser(ctx, db, repository.UpdateUserParams{UserUUID: &claimUUID, Username: userReq.Username, Email: userReq.Email, Password: userReq.Password})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error updating user: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	response := UserResponse{
-		UUID:      updatedUser.UUID.String(),
-		Username:  updatedUser.Username,
-		Email:     updatedUser.Email,
-		CreatedAt: updatedUser.CreatedAt,
-		UpdatedAt: updatedUser.UpdatedAt,
+	// A new password logs out every other device, in case the old one leaked.
+	if userReq.Password != nil {
+		sessionID, _ := r.Context().Value("session_id").(uuid.UUID)
+		if _, err := revokeOtherSessions(ctx, db, updatedUser.ID, sessionID); err != nil {
+			http.Error(w, fmt.Sprintf("Error revoking other sessions: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if userReq.Email != nil && !updatedUser.Verified {
+		sendVerificationEmailAsync(db, updatedUser)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(newUserResponse(updatedUser))
+}
+
+// GetCurrentUser returns the full profile of the caller.
+func GetCurrentUser(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	user, err := repository.GetUserByID(r.Context(), db, userID)
+	if err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error retrieving user: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newUserResponse(user))
+}
+
+// GetUser returns the public profile of a user, or the full profile when the
+// caller asks for themselves.
+func GetUser(w http.ResponseWriter, r *http.Request) {
+	claimUUID, ok := r.Context().Value("user_uuid").(uuid.UUID)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userUUID, err := uuid.Parse(mux.Vars(r)["uuid"])
+	if err != nil {
+		http.Error(w, "Invalid user UUID", http.StatusBadRequest)
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	user, err := repository.GetUserByUUID(r.Context(), db, userUUID)
+	if err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error retrieving user: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if user.UUID == claimUUID {
+		json.NewEncoder(w).Encode(newUserResponse(user))
+		return
+	}
+	json.NewEncoder(w).Encode(newPublicUserResponse(user))
+}
+
+// BatchGetUsers resolves many user UUIDs to public profiles in one request,
+// e.g. the senders of a page of messages. Profiles come back in request
+// order, without duplicates; unknown UUIDs are skipped.
+func BatchGetUsers(w http.ResponseWriter, r *http.Request) {
+	var batchReq BatchGetUsersRequest
+	if err := json.NewDecoder(r.Body).Decode(&batchReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.ValidateStruct(batchReq); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	userUUIDs := make([]uuid.UUID, 0, len(batchReq.UUIDs))
+	for _, userUUID := range batchReq.UUIDs {
+		userUUIDs = append(userUUIDs, uuid.MustParse(userUUID))
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	users, err := repository.GetUsersByUUIDs(r.Context(), db, userUUIDs)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving users: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	byUUID := make(map[uuid.UUID]*models.User, len(users))
+	for i := range users {
+		byUUID[users[i].UUID] = &users[i]
+	}
+
+	response := make([]PublicUserResponse, 0, len(users))
+	for _, userUUID := range userUUIDs {
+		if user, ok := byUUID[userUUID]; ok {
+			response = append(response, newPublicUserResponse(user))
+			delete(byUUID, userUUID)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// SearchUsers finds users by username so that the caller can start a
+// conversation: "q" matches username prefixes first, then similar usernames.
+// Users blocked by or blocking the caller are left out.
+func SearchUsers(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("user_id").(int64)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	params := repository.SearchUsersParams{
+		SearcherID: userID,
+		Query:      strings.TrimSpace(query.Get("q")),
+		Limit:      defaultUserSearchLimit,
+	}
+
+	if params.Query == "" || len(params.Query) > maxUserSearchLength {
+		http.Error(w, fmt.Sprintf("q must be between 1 and %d characters", maxUserSearchLength), http.StatusBadRequest)
+		return
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		parsedLimit, err := strconv.Atoi(limit)
+		if err != nil || parsedLimit < 1 || parsedLimit > maxUserSearchLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxUserSearchLimit), http.StatusBadRequest)
+			return
+		}
+		params.Limit = parsedLimit
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		offset, err := repository.DecodeSearchCursor(cursor)
+		if err != nil || offset >= maxUserSearchResults {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		params.Offset = offset
+	}
+	params.Limit = min(params.Limit, maxUserSearchResults-params.Offset)
+
+	db, err := database.GetDb()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not connect to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	result, err := repository.SearchUsers(r.Context(), db, params)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error searching users: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := UserSearchResponse{
+		Users: make([]PublicUserResponse, 0, len(result.Users)),
+	}
+	for i := range result.Users {
+		response.Users = append(response.Users, newPublicUserResponse(&result.Users[i]))
+	}
+
+	nextOffset := params.Offset + len(result.Users)
+	if result.HasMore && nextOffset < maxUserSearchResults {
+		response.HasMore = true
+		response.NextCursor = repository.EncodeSearchCursor(nextOffset)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
+
+func newUserResponse(user *models.User) UserResponse {
+	return UserResponse{
+		UUID:      user.UUID.String(),
+		Username:  user.Username,
+		Email:     user.Email,
+		Verified:  user.Verified,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+	}
+}
+
+func newPublicUserResponse(user *models.User) PublicUserResponse {
+	return PublicUserResponse{
+		UUID:      user.UUID.String(),
+		Username:  user.Username,
+		CreatedAt: user.CreatedAt,
+	}
+}
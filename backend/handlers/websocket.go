@@ -1,18 +1,84 @@
 package handlers
 
 import (
-	"github.com/gorilla/websocket"
+	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/ratelimit"
+	"github.com/AndreaCasaluci/go-chat-app/utils"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed to write a frame to the peer.
+	writeWait = 10 * time.Second
+
+	// Time allowed to read the next pong from the peer.
+	pongWait = 60 * time.Second
+
+	// Send pings with this period, must be less than pongWait.
+	pingPeriod = (pongWait * 9) / 10
+
+	// Frames buffered per connection before it is considered too slow and dropped.
+	sendBufferSize = 256
+
+	// Largest inbound frame accepted. The longest allowed text is 4000 runes;
+	// escaped as \uXXXX\uXXXX surrogate pairs, astral-plane runes take 12
+	// bytes each, so a message.send carrying it can reach about 47 KiB plus
+	// the rest of the frame.
+	maxFrameSize = 64 << 10
+
+	// Consecutive rate limited frames after which the connection is closed,
+	// since the client is ignoring the rate_limited errors.
+	maxRateLimitedFrames = 20
 )
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true //Allow all origin
-	},
+	CheckOrigin:  checkOrigin,
+	Subprotocols: []string{"access_token"},
 }
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+// Client is a single authenticated WebSocket connection registered in the Hub.
+type Client struct {
+	UserID    int64
+	UserUUID  uuid.UUID
+	Username  string
+	SessionID uuid.UUID
+	// Scopes limits a connection opened with a personal access token; it is
+	// nil for interactive sessions, which are not limited.
+	Scopes []string
+
+	hub  *Hub
+	conn *websocket.Conn
+	send chan []byte
+
+	mu     sync.Mutex
+	closed bool
+
+	// connID keys the rate limit bucket of this connection.
+	connID uuid.UUID
+	// rateLimited counts consecutive frames refused by the rate limits.
+	rateLimited int
+}
+
+func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(int64)
+	userUUID, ok := r.Context().Value("user_uuid").(uuid.UUID)
+	if !ok || userUUID == uuid.Nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	username, _ := r.Context().Value("username").(string)
+	sessionID, _ := r.Context().Value("session_id").(uuid.UUID)
+	scopes, _ := r.Context().Value("token_scopes").([]string)
+
 	//Upgrade the HTTP connection to WebSocket
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -20,19 +86,211 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	defer conn.Close()
+	client := &Client{
+		UserID:    userID,
+		UserUUID:  userUUID,
+		Username:  username,
+		SessionID: sessionID,
+		Scopes:    scopes,
+		hub:       GetHub(),
+		conn:      conn,
+		send:      make(chan []byte, sendBufferSize),
+		connID:    uuid.New(),
+	}
+	client.hub.Register(client)
+
+	go client.writePump()
+	client.readPump()
+}
+
+func (c *Client) readPump() {
+	defer func() {
+		c.hub.Unregister(c)
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(maxFrameSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
 
-	// Infinite loop to read and write messages to the WebSocket
 	for {
-		messageType, p, err := conn.ReadMessage()
+		messageType, data, err := c.conn.ReadMessage()
 		if err != nil {
-			log.Println(err)
-			break
+			if errors.Is(err, websocket.ErrReadLimit) {
+				log.Printf("Closing WebSocket connection for user %s: frame larger than %d bytes", c.UserUUID, maxFrameSize)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("WebSocket read error for user %s: %v", c.UserUUID, err)
+			}
+			return
+		}
+
+		if retryAfter := c.takeFrameQuota(); retryAfter > 0 {
+			c.rateLimited++
+			if c.rateLimited > maxRateLimitedFrames {
+				log.Printf("Closing flooding WebSocket connection for user %s", c.UserUUID)
+				c.closeWithReason(websocket.ClosePolicyViolation, "rate limit exceeded")
+				return
+			}
+
+			// Only to echo client_id back; a malformed frame just gets none.
+			var frame inboundFrame
+			json.Unmarshal(data, &frame)
+			c.sendRateLimited(frame.ClientID, "Too many frames, slow down", retryAfter)
+			continue
+		}
+		c.rateLimited = 0
+
+		if messageType != websocket.TextMessage {
+			c.sendError("", "unsupported_frame", "Only text frames are supported")
+			continue
+		}
+
+		c.handleFrame(data)
+	}
+}
+
+// takeFrameQuota takes one frame from the quotas of the connection and of the
+// user across all their connections. It returns how long the client must
+// wait when either is exhausted, or zero.
+func (c *Client) takeFrameQuota() time.Duration {
+	policies, err := ratelimit.GetRoutePolicies()
+	if err != nil {
+		log.Printf("Error loading WebSocket rate limits: %v", err)
+		return 0
+	}
+
+	limiter := ratelimit.GetTokenBucketLimiter()
+	if decision := limiter.Take("ws:conn:"+c.connID.String(), policies.WSConnection); !decision.Allowed {
+		return decision.Reset
+	}
+	if decision := limiter.Take("ws:user:"+c.UserUUID.String(), policies.WSUser); !decision.Allowed {
+		return decision.Reset
+	}
+	return 0
+}
+
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case payload, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				log.Printf("WebSocket write error for user %s: %v", c.UserUUID, err)
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// hasScope reports whether the connection may act under scope.
+func (c *Client) hasScope(scope string) bool {
+	if c.Scopes == nil {
+		return true
+	}
+	for _, granted := range c.Scopes {
+		if granted == scope {
+			return true
 		}
-		// Echo the message back to the client
-		if err := conn.WriteMessage(messageType, p); err != nil {
-			log.Println(err)
-			break
+	}
+	return false
+}
+
+// enqueue queues payload for the write pump. A connection whose buffer is
+// full is too slow to keep up and gets closed instead of blocking the sender.
+func (c *Client) enqueue(payload []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+
+	select {
+	case c.send <- payload:
+		return true
+	default:
+		log.Printf("Dropping slow WebSocket connection for user %s", c.UserUUID)
+		c.conn.Close()
+		return false
+	}
+}
+
+func (c *Client) sendJSON(frame interface{}) {
+	payload, err := json.Marshal(frame)
+	if err != nil {
+		log.Printf("Error encoding WebSocket frame: %v", err)
+		return
+	}
+	c.enqueue(payload)
+}
+
+func (c *Client) closeSend() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+}
+
+// closeWithReason sends a close frame with code and reason, then terminates
+// the connection.
+func (c *Client) closeWithReason(code int, reason string) {
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+	c.conn.Close()
+}
+
+// Close terminates the underlying connection; the read pump then unregisters
+// the client from the hub.
+func (c *Client) Close() {
+	c.conn.Close()
+}
+
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// Non-browser clients do not send an Origin header.
+		return true
+	}
+
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	if strings.EqualFold(originURL.Host, r.Host) {
+		return true
+	}
+
+	config, err := utils.GetConfig()
+	if err != nil {
+		return false
+	}
+
+	for _, allowed := range strings.Split(config.AllowedOrigins, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
 		}
 	}
+
+	return false
 }
@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/db"
+	"github.com/AndreaCasaluci/go-chat-app/models"
+	"github.com/AndreaCasaluci/go-chat-app/repository"
+	"github.com/AndreaCasaluci/go-chat-app/utils"
+	"github.com/google/uuid"
+)
+
+// Frame types exchanged over the WebSocket. Every frame is a JSON object with
+// a "type" field; the remaining fields depend on the type.
+const (
+	FrameTypeError       = "error"
+	FrameTypeMessageSend = "message.send"
+	FrameTypeMessageAck  = "message.ack"
+	FrameTypeMessageNew  = "message.new"
+)
+
+// Time allowed for the database work triggered by a single inbound frame.
+const frameTimeout = 5 * time.Second
+
+// inboundFrame is the envelope of every frame sent by a client. ClientID is
+// an optional client-chosen reference echoed back in replies to that frame.
+type inboundFrame struct {
+	Type     string `json:"type"`
+	ClientID string `json:"client_id,omitempty"`
+}
+
+// sendMessageFrame addresses either a user ("to") or a group ("group_id").
+type sendMessageFrame struct {
+	To      string `json:"to" validate:"required_without=GroupID,excluded_with=GroupID,omitempty,uuid"`
+	GroupID string `json:"group_id" validate:"omitempty,uuid"`
+	Text    string `json:"text" validate:"required_without=MediaID,max=4000"`
+	MediaID string `json:"media_id" validate:"omitempty,uuid"`
+}
+
+type errorFrame struct {
+	Type     string `json:"type"`
+	ClientID string `json:"client_id,omitempty"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	// RetryAfter is set on rate_limited errors to the number of seconds to
+	// wait before sending again.
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+type messageAckFrame struct {
+	Type      string    `json:"type"`
+	ClientID  string    `json:"client_id,omitempty"`
+	UUID      uuid.UUID `json:"uuid"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type messageNewFrame struct {
+	Type    string          `json:"type"`
+	Message MessageResponse `json:"message"`
+}
+
+func (c *Client) handleFrame(data []byte) {
+	var frame inboundFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		c.sendError("", "invalid_frame", "Frame is not valid JSON")
+		return
+	}
+
+	switch frame.Type {
+	case FrameTypeMessageSend:
+		c.handleSendMessage(frame, data)
+	default:
+		c.sendError(frame.ClientID, "unknown_type", "Unknown frame type: "+frame.Type)
+	}
+}
+
+func (c *Client) handleSendMessage(frame inboundFrame, data []byte) {
+	if !c.hasScope(models.ScopeMessagesWrite) {
+		c.sendError(frame.ClientID, "forbidden", "Token is missing the messages:write scope")
+		return
+	}
+
+	var sendReq sendMessageFrame
+	if err := json.Unmarshal(data, &sendReq); err != nil {
+		c.sendError(frame.ClientID, "invalid_frame", "Invalid message.send frame")
+		return
+	}
+
+	if err := utils.ValidateStruct(sendReq); err != nil {
+		c.sendError(frame.ClientID, "validation_error", err.Error())
+		return
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		c.sendError(frame.ClientID, "internal_error", "Could not connect to the database")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), frameTimeout)
+	defer cancel()
+
+	content, ok := c.resolveMessageContent(ctx, db, frame, sendReq)
+	if !ok {
+		return
+	}
+
+	if sendReq.GroupID != "" {
+		c.sendGroupMessage(ctx, db, frame, sendReq, content)
+		return
+	}
+	c.sendDirectMessage(ctx, db, frame, sendReq, content)
+}
+
+// resolveMessageContent builds the text and media part of a new message.
+// Attachments must be uploads owned by the sender, never arbitrary URLs.
+func (c *Client) resolveMessageContent(ctx context.Context, db *sql.DB, frame inboundFrame, sendReq sendMessageFrame) (repository.CreateMessageParams, bool) {
+	content := repository.CreateMessageParams{
+		SenderID:    c.UserID,
+		SenderUUID:  c.UserUUID,
+		MessageText: sendReq.Text,
+		MediaType:   "text",
+	}
+
+	if sendReq.MediaID == "" {
+		return content, true
+	}
+
+	media, err := repository.GetMediaByUUID(ctx, db, uuid.MustParse(sendReq.MediaID))
+	if err != nil && !errors.Is(err, repository.ErrMediaNotFound) {
+		log.Printf("Error looking up media: %v", err)
+		c.sendError(frame.ClientID, "internal_error", "Could not look up media")
+		return content, false
+	}
+	if err != nil || media.OwnerID != c.UserID {
+		c.sendError(frame.ClientID, "not_found", "Media not found")
+		return content, false
+	}
+
+	content.MediaType = media.MediaType
+	content.MediaURL = media.ObjectKey
+	content.Media = media
+	return content, true
+}
+
+func (c *Client) sendDirectMessage(ctx context.Context, db *sql.DB, frame inboundFrame, sendReq sendMessageFrame, content repository.CreateMessageParams) {
+	receiver, err := repository.GetUserByUUID(ctx, db, uuid.MustParse(sendReq.To))
+	if err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			c.sendError(frame.ClientID, "not_found", "Recipient not found")
+			return
+		}
+		log.Printf("Error looking up message recipient: %v", err)
+		c.sendError(frame.ClientID, "internal_error", "Could not look up recipient")
+		return
+	}
+
+	blocked, err := repository.IsBlockedBetween(ctx, db, c.UserID, receiver.ID)
+	if err != nil {
+		c.sendError(frame.ClientID, "internal_error", "Could not look up recipient")
+		return
+	}
+	if blocked {
+		c.sendError(frame.ClientID, "forbidden", "You cannot message this user")
+		return
+	}
+
+	content.ReceiverID = &receiver.ID
+	content.ReceiverUUID = &receiver.UUID
+
+	message, err := repository.CreateMessage(ctx, db, content)
+	if err != nil {
+		c.sendError(frame.ClientID, "internal_error", "Could not store message")
+		return
+	}
+
+	c.ackMessage(frame, message)
+
+	// The sender's other devices get the message too so conversations stay in sync.
+	recipients := []uuid.UUID{receiver.UUID}
+	if receiver.UUID != c.UserUUID {
+		recipients = append(recipients, c.UserUUID)
+	}
+	c.deliverMessage(message, recipients)
+}
+
+func (c *Client) sendGroupMessage(ctx context.Context, db *sql.DB, frame inboundFrame, sendReq sendMessageFrame, content repository.CreateMessageParams) {
+	group, members, err := GetGroupCache().Get(ctx, db, uuid.MustParse(sendReq.GroupID))
+	if err != nil && !errors.Is(err, repository.ErrGroupNotFound) {
+		log.Printf("Error loading group members: %v", err)
+		c.sendError(frame.ClientID, "internal_error", "Could not look up group")
+		return
+	}
+
+	sender, isMember := members[c.UserID]
+	if err != nil || !isMember {
+		c.sendError(frame.ClientID, "not_found", "Group not found")
+		return
+	}
+
+	if !sender.Role.CanPost(group) {
+		c.sendError(frame.ClientID, "forbidden", "Only group owners and admins can post in this group")
+		return
+	}
+
+	content.GroupID = &group.ID
+	content.GroupUUID = &group.UUID
+
+	var slowMode time.Duration
+	if !sender.Role.BypassesSlowMode() {
+		slowMode = time.Duration(group.SlowModeSeconds) * time.Second
+	}
+
+	message, wait, err := repository.CreateGroupMessage(ctx, db, content, slowMode)
+	if errors.Is(err, repository.ErrNotGroupMember) {
+		GetGroupCache().Invalidate(group.UUID)
+		c.sendError(frame.ClientID, "not_found", "Group not found")
+		return
+	}
+	if err != nil {
+		c.sendError(frame.ClientID, "internal_error", "Could not store message")
+		return
+	}
+	if wait > 0 {
+		c.sendRateLimited(frame.ClientID, "Slow mode is on in this group", wait)
+		return
+	}
+
+	c.ackMessage(frame, message)
+
+	recipients := make([]uuid.UUID, 0, len(members))
+	for _, member := range members {
+		recipients = append(recipients, member.UserUUID)
+	}
+	c.deliverMessage(message, recipients)
+}
+
+func (c *Client) ackMessage(frame inboundFrame, message *models.Message) {
+	c.sendJSON(messageAckFrame{
+		Type:      FrameTypeMessageAck,
+		ClientID:  frame.ClientID,
+		UUID:      message.UUID,
+		CreatedAt: message.CreatedAt,
+	})
+}
+
+// deliverMessage pushes a stored message to every open connection of the
+// recipients, except the connection it was sent from which already got an ack.
+func (c *Client) deliverMessage(message *models.Message, recipients []uuid.UUID) {
+	payload, err := json.Marshal(messageNewFrame{Type: FrameTypeMessageNew, Message: newMessageResponse(message)})
+	if err != nil {
+		log.Printf("Error encoding WebSocket frame: %v", err)
+		return
+	}
+
+	for _, recipient := range recipients {
+		c.hub.SendToUserExcept(recipient, payload, c)
+	}
+}
+
+func (c *Client) sendError(clientID, code, message string) {
+	c.sendJSON(errorFrame{
+		Type:     FrameTypeError,
+		ClientID: clientID,
+		Code:     code,
+		Message:  message,
+	})
+}
+
+func (c *Client) sendRateLimited(clientID, message string, retryAfter time.Duration) {
+	c.sendJSON(errorFrame{
+		Type:       FrameTypeError,
+		ClientID:   clientID,
+		Code:       "rate_limited",
+		Message:    message,
+		RetryAfter: int(math.Ceil(retryAfter.Seconds())),
+	})
+}
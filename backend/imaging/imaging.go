@@ -0,0 +1,172 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// Thumbnails fit within a ThumbnailSize x ThumbnailSize box.
+	ThumbnailSize = 320
+
+	// Images above this many pixels are rejected before decoding so that a
+	// small upload cannot expand into gigabytes of memory.
+	maxPixels = 50_000_000
+
+	jpegQuality          = 90
+	thumbnailJPEGQuality = 80
+)
+
+var (
+	ErrImageTooLarge = errors.New("image dimensions are too large")
+	ErrInvalidImage  = errors.New("image could not be decoded")
+)
+
+// ProcessedImage is an uploaded image ready to be stored: the original with
+// its metadata removed, its display dimensions and a thumbnail.
+type ProcessedImage struct {
+	Data                 []byte
+	Width                int
+	Height               int
+	Thumbnail            []byte
+	ThumbnailContentType string
+}
+
+// ProcessImage strips metadata from an uploaded image and renders its
+// thumbnail. JPEGs whose EXIF orientation is not the default are re-encoded
+// upright, since dropping the EXIF block would otherwise lose the rotation.
+func ProcessImage(data []byte, contentType string) (*ProcessedImage, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, ErrInvalidImage
+	}
+	if int64(config.Width)*int64(config.Height) > maxPixels {
+		return nil, ErrImageTooLarge
+	}
+
+	orientation := 1
+	if contentType == "image/jpeg" {
+		orientation = jpegOrientation(data)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	img = applyOrientation(img, orientation)
+
+	processed := &ProcessedImage{
+		Width:  img.Bounds().Dx(),
+		Height: img.Bounds().Dy(),
+	}
+
+	if orientation != 1 {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return nil, fmt.Errorf("could not encode image: %w", err)
+		}
+		processed.Data = buf.Bytes()
+	} else {
+		processed.Data, err = StripMetadata(data, contentType)
+		if err != nil {
+			return nil, ErrInvalidImage
+		}
+	}
+
+	processed.Thumbnail, processed.ThumbnailContentType, err = renderThumbnail(img)
+	if err != nil {
+		return nil, err
+	}
+
+	return processed, nil
+}
+
+// renderThumbnail scales img down to fit the thumbnail box. Opaque images are
+// encoded as JPEG, images with transparency as PNG.
+func renderThumbnail(img image.Image) ([]byte, string, error) {
+	bounds := img.Bounds()
+	width, height := fitWithin(bounds.Dx(), bounds.Dy(), ThumbnailSize)
+
+	thumbnail := image.NewNRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(thumbnail, thumbnail.Bounds(), img, bounds, draw.Src, nil)
+
+	var buf bytes.Buffer
+	if thumbnail.Opaque() {
+		if err := jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: thumbnailJPEGQuality}); err != nil {
+			return nil, "", fmt.Errorf("could not encode thumbnail: %w", err)
+		}
+		return buf.Bytes(), "image/jpeg", nil
+	}
+
+	if err := png.Encode(&buf, thumbnail); err != nil {
+		return nil, "", fmt.Errorf("could not encode thumbnail: %w", err)
+	}
+	return buf.Bytes(), "image/png", nil
+}
+
+// fitWithin scales width x height down to fit a size x size box, keeping the
+// aspect ratio. Images that already fit are left at their size.
+func fitWithin(width, height, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+	if width >= height {
+		return size, max(1, height*size/width)
+	}
+	return max(1, width*size/height), size
+}
+
+// applyOrientation transforms img so that it displays upright for the given
+// EXIF orientation value.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	outWidth, outHeight := width, height
+	if orientation >= 5 {
+		outWidth, outHeight = height, width
+	}
+
+	out := image.NewNRGBA(image.Rect(0, 0, outWidth, outHeight))
+	for y := 0; y < outHeight; y++ {
+		for x := 0; x < outWidth; x++ {
+			var srcX, srcY int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				srcX, srcY = width-1-x, y
+			case 3: // Rotated 180°
+				srcX, srcY = width-1-x, height-1-y
+			case 4: // Mirrored vertically
+				srcX, srcY = x, height-1-y
+			case 5: // Transposed
+				srcX, srcY = y, x
+			case 6: // Rotated 90° clockwise
+				srcX, srcY = y, height-1-x
+			case 7: // Transversed
+				srcX, srcY = width-1-y, height-1-x
+			case 8: // Rotated 90° counter-clockwise
+				srcX, srcY = width-1-y, x
+			}
+			out.Set(x, y, color.NRGBAModel.Convert(img.At(bounds.Min.X+srcX, bounds.Min.Y+srcY)))
+		}
+	}
+
+	return out
+}
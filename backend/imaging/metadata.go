@@ -0,0 +1,233 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var errMalformedImage = errors.New("malformed image")
+
+// StripMetadata removes EXIF, XMP, IPTC and text metadata from an encoded
+// image without re-encoding the pixel data. Formats that carry no such
+// metadata are returned unchanged.
+func StripMetadata(data []byte, contentType string) ([]byte, error) {
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEGMetadata(data)
+	case "image/png":
+		return stripPNGMetadata(data)
+	case "image/webp":
+		return stripWebPMetadata(data)
+	default:
+		return data, nil
+	}
+}
+
+// stripJPEGMetadata drops APP1 (EXIF, XMP), APP13 (IPTC) and comment segments
+// from the header of a JPEG. Everything from the start of scan is copied as is.
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errMalformedImage
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	pos := 2
+	for pos < len(data) {
+		if data[pos] != 0xFF {
+			return nil, errMalformedImage
+		}
+		// Markers may be preceded by any number of 0xFF fill bytes.
+		for pos < len(data) && data[pos] == 0xFF {
+			pos++
+		}
+		if pos >= len(data) {
+			return nil, errMalformedImage
+		}
+		marker := data[pos]
+		segmentStart := pos - 1
+		pos++
+
+		// Start of scan and end of image: the rest is entropy-coded data.
+		if marker == 0xDA || marker == 0xD9 {
+			out.Write(data[segmentStart:])
+			return out.Bytes(), nil
+		}
+
+		// Standalone markers carry no length.
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			out.Write(data[segmentStart:pos])
+			continue
+		}
+
+		if pos+2 > len(data) {
+			return nil, errMalformedImage
+		}
+		length := int(binary.BigEndian.Uint16(data[pos:]))
+		if length < 2 || pos+length > len(data) {
+			return nil, errMalformedImage
+		}
+		segmentEnd := pos + length
+		pos = segmentEnd
+
+		if marker == 0xE1 || marker == 0xED || marker == 0xFE {
+			continue
+		}
+		out.Write(data[segmentStart:segmentEnd])
+	}
+
+	return nil, errMalformedImage
+}
+
+// stripPNGMetadata drops the eXIf, text and modification-time chunks of a PNG.
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	const signatureLength = 8
+	if len(data) < signatureLength || string(data[1:4]) != "PNG" {
+		return nil, errMalformedImage
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:signatureLength])
+
+	pos := signatureLength
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, errMalformedImage
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		// Length, type, data and CRC.
+		chunkEnd := pos + 12 + length
+		if length < 0 || chunkEnd > len(data) {
+			return nil, errMalformedImage
+		}
+
+		switch chunkType {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out.Write(data[pos:chunkEnd])
+		}
+
+		pos = chunkEnd
+		if chunkType == "IEND" {
+			break
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+// stripWebPMetadata drops the EXIF and XMP chunks of an extended WebP and
+// clears the matching feature flags of its VP8X header.
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	const headerLength = 12
+	if len(data) < headerLength || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errMalformedImage
+	}
+
+	const (
+		exifFlag = 0x08
+		xmpFlag  = 0x04
+	)
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:headerLength])
+
+	pos := headerLength
+	for pos+8 <= len(data) {
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		// Chunks are padded to an even size.
+		chunkEnd := pos + 8 + size + size%2
+		if size < 0 || chunkEnd > len(data) {
+			return nil, errMalformedImage
+		}
+
+		switch fourCC {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte(nil), data[pos:chunkEnd]...)
+			if size > 0 {
+				chunk[8] &^= exifFlag | xmpFlag
+			}
+			out.Write(chunk)
+		default:
+			out.Write(data[pos:chunkEnd])
+		}
+
+		pos = chunkEnd
+	}
+
+	result := out.Bytes()
+	binary.LittleEndian.PutUint32(result[4:], uint32(len(result)-8))
+	return result, nil
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) of a JPEG, or 1 when the
+// image carries none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xFF {
+		marker := data[pos+1]
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return 1
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+
+	return 1
+}
+
+// exifOrientation reads the Orientation tag (0x0112) from the first IFD of a
+// TIFF-structured EXIF block.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifdOffset := int(order.Uint32(tiff[4:]))
+	if ifdOffset < 8 || ifdOffset+2 > len(tiff) {
+		return 1
+	}
+
+	entries := int(order.Uint16(tiff[ifdOffset:]))
+	for i := 0; i < entries; i++ {
+		entry := ifdOffset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+
+	return 1
+}
@@ -0,0 +1,58 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+var ErrFFmpegUnavailable = errors.New("ffmpeg is not installed")
+
+// posterTimeout bounds the ffmpeg run on an uploaded video, which a crafted
+// file could otherwise keep busy for as long as the upload request lasts.
+const posterTimeout = 15 * time.Second
+
+// ProcessVideoPoster extracts a representative frame from the video at path
+// with ffmpeg and renders it as the video's poster thumbnail. Width and
+// Height are those of the video; Data is left empty.
+func ProcessVideoPoster(ctx context.Context, path string) (*ProcessedImage, error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, ErrFFmpegUnavailable
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, posterTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg,
+		"-hide_banner", "-loglevel", "error",
+		"-i", path,
+		"-vf", "thumbnail",
+		"-frames:v", "1",
+		"-f", "image2pipe", "-c:v", "png",
+		"-",
+	)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("could not extract poster frame: ffmpeg took longer than %s", posterTimeout)
+		}
+		return nil, fmt.Errorf("could not extract poster frame: %v: %s", err, stderr.String())
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("could not extract poster frame: no frame decoded")
+	}
+
+	poster, err := ProcessImage(stdout.Bytes(), "image/png")
+	if err != nil {
+		return nil, err
+	}
+	poster.Data = nil
+	return poster, nil
+}
@@ -0,0 +1,45 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogMailer stands in for a real mail server in local development and tests.
+// Messages are written to the application log, or appended to a file when a
+// path is given so that tests and developers can pick up the links they hold.
+type LogMailer struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewLogMailer(path string) *LogMailer {
+	return &LogMailer{path: path}
+}
+
+func (m *LogMailer) Send(ctx context.Context, message Message) error {
+	if m.path == "" {
+		log.Printf("Email to %s: %s\n%s", message.To, message.Subject, message.Body)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, err := os.OpenFile(m.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("could not open mail log: %w", err)
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n",
+		time.Now().Format(time.RFC1123Z), message.To, message.Subject, message.Body)
+	if err != nil {
+		return fmt.Errorf("could not write mail log: %w", err)
+	}
+	return nil
+}
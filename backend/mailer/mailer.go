@@ -0,0 +1,57 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/AndreaCasaluci/go-chat-app/utils"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional emails such as address verification links.
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+var mailer Mailer = nil
+
+func newMailer() (Mailer, error) {
+	config, err := utils.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.MailerBackend {
+	case "", "log":
+		return NewLogMailer(config.MailLogFile), nil
+	case "smtp":
+		return NewSMTPMailer(SMTPOptions{
+			Host:     config.SMTPHost,
+			Port:     config.SMTPPort,
+			Username: config.SMTPUsername,
+			Password: config.SMTPPassword,
+			From:     config.MailFrom,
+		})
+	default:
+		return nil, fmt.Errorf("unknown mailer backend %q", config.MailerBackend)
+	}
+}
+
+func GetMailer() (Mailer, error) {
+	if mailer != nil {
+		return mailer, nil
+	}
+
+	m, err := newMailer()
+	if err != nil {
+		return nil, err
+	}
+	mailer = m
+	return mailer, nil
+}
@@ -0,0 +1,99 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SMTPMailer delivers messages through an SMTP relay. The connection is
+// upgraded with STARTTLS whenever the server offers it, and credentials are
+// only sent over TLS or to localhost, as enforced by smtp.PlainAuth.
+type SMTPMailer struct {
+	addr string
+	host string
+	auth smtp.Auth
+	from mail.Address
+}
+
+type SMTPOptions struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func NewSMTPMailer(options SMTPOptions) (*SMTPMailer, error) {
+	if options.Host == "" {
+		return nil, fmt.Errorf("missing SMTP host")
+	}
+
+	from, err := mail.ParseAddress(options.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address %q: %w", options.From, err)
+	}
+
+	port := options.Port
+	if port == "" {
+		port = "587"
+	}
+
+	var auth smtp.Auth
+	if options.Username != "" {
+		auth = smtp.PlainAuth("", options.Username, options.Password, options.Host)
+	}
+
+	return &SMTPMailer{
+		addr: net.JoinHostPort(options.Host, port),
+		host: options.Host,
+		auth: auth,
+		from: *from,
+	}, nil
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, message Message) error {
+	to, err := mail.ParseAddress(message.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient address %q: %w", message.To, err)
+	}
+
+	// smtp.SendMail has no context support, so run it aside and stop waiting
+	// when the context ends.
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- smtp.SendMail(m.addr, m.auth, m.from.Address, []string{to.Address}, m.compose(to, message))
+	}()
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			return fmt.Errorf("could not send email: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func (m *SMTPMailer) compose(to *mail.Address, message Message) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + m.from.String() + "\r\n")
+	b.WriteString("To: " + to.String() + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", message.Subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("Message-ID: <" + uuid.NewString() + "@" + m.host + ">\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(message.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
@@ -2,13 +2,28 @@ package middleware
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/AndreaCasaluci/go-chat-app/db"
+	"github.com/AndreaCasaluci/go-chat-app/models"
+	"github.com/AndreaCasaluci/go-chat-app/repository"
 	"github.com/AndreaCasaluci/go-chat-app/utils"
 )
 
-func JWTMiddleware(next http.HandlerFunc) http.HandlerFunc {
+// webSocketTokenProtocol is the subprotocol browsers send alongside the token,
+// since they cannot set an Authorization header on a WebSocket handshake:
+// new WebSocket(url, ["access_token", token]).
+const webSocketTokenProtocol = "access_token"
+
+// JWTMiddleware authenticates the request with the access token in the
+// Authorization header. Personal access tokens are accepted too, but only on
+// routes that list the scopes they require, and only if they hold them all.
+func JWTMiddleware(next http.HandlerFunc, scopes ...string) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
@@ -16,25 +31,222 @@ func JWTMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		tokenString := strings.Split(authHeader, "Bearer ")
-		if len(tokenString) != 2 {
+		tokenString, ok := bearerToken(authHeader)
+		if !ok {
 			http.Error(w, "Invalid token format", http.StatusUnauthorized)
 			return
 		}
 
-		claims, err := utils.ValidateToken(tokenString[1])
-		if err != nil {
-			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		if utils.IsPersonalAccessToken(tokenString) {
+			if len(scopes) == 0 {
+				http.Error(w, "Personal access tokens are not accepted on this route", http.StatusForbidden)
+				return
+			}
+
+			token, r, ok := authenticatePersonalAccessToken(w, r, tokenString)
+			if !ok {
+				return
+			}
+			for _, scope := range scopes {
+				if !token.HasScope(scope) {
+					http.Error(w, fmt.Sprintf("Token is missing the %s scope", scope), http.StatusForbidden)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r, ok = authenticateJWT(w, r, tokenString)
+		if !ok {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// WebSocketJWTMiddleware authenticates a WebSocket handshake with the same JWT
+// accepted by JWTMiddleware. The token is read from the Authorization header,
+// the "token" query parameter or the access_token subprotocol, in that order.
+// Personal access tokens need messages:read or messages:write; the connection
+// then only receives or only sends messages unless the token holds both.
+func WebSocketJWTMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenString := webSocketToken(r)
+		if tokenString == "" {
+			http.Error(w, "Missing authentication token", http.StatusUnauthorized)
 			return
 		}
 
-		ctx := r.Context()
-		ctx = context.WithValue(ctx, "user_id", claims.UserID)
-		ctx = context.WithValue(ctx, "user_uuid", claims.UserUUID)
-		ctx = context.WithValue(ctx, "username", claims.Username)
-		ctx = context.WithValue(ctx, "email", claims.Email)
-		r = r.WithContext(ctx)
+		if utils.IsPersonalAccessToken(tokenString) {
+			token, r, ok := authenticatePersonalAccessToken(w, r, tokenString)
+			if !ok {
+				return
+			}
+			if !token.HasScope(models.ScopeMessagesRead) && !token.HasScope(models.ScopeMessagesWrite) {
+				http.Error(w, "Token needs the messages:read or messages:write scope", http.StatusForbidden)
+				return
+			}
 
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r, ok := authenticateJWT(w, r, tokenString)
+		if !ok {
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// authenticateJWT validates an access token and returns the request carrying
+// its claims, or writes an error response and returns false.
+func authenticateJWT(w http.ResponseWriter, r *http.Request, tokenString string) (*http.Request, bool) {
+	claims, err := authenticate(r.Context(), tokenString)
+	if err != nil {
+		if errors.Is(err, errRevocationCheckFailed) {
+			http.Error(w, "Could not verify token", http.StatusInternalServerError)
+			return nil, false
+		}
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return nil, false
+	}
+	return withClaims(r, claims), true
+}
+
+// authenticatePersonalAccessToken looks a personal access token up and
+// returns it with the request carrying its owner, or writes an error
+// response and returns false.
+func authenticatePersonalAccessToken(w http.ResponseWriter, r *http.Request, tokenString string) (*models.PersonalAccessToken, *http.Request, bool) {
+	db, err := database.GetDb()
+	if err != nil {
+		log.Printf("Error connecting to the database: %v", err)
+		http.Error(w, "Could not verify token", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	token, user, err := repository.AuthenticatePersonalAccessToken(r.Context(), db, utils.HashToken(tokenString))
+	if err != nil {
+		if errors.Is(err, repository.ErrPersonalAccessTokenInvalid) {
+			http.Error(w, "Invalid, expired or revoked token", http.StatusUnauthorized)
+			return nil, nil, false
+		}
+		http.Error(w, "Could not verify token", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	return token, withPersonalAccessToken(r, token, user), true
+}
+
+var errRevocationCheckFailed = errors.New("could not check token revocation")
+
+// authenticate validates the token and rejects it when either the token
+// itself or the session it belongs to has been revoked.
+func authenticate(ctx context.Context, tokenString string) (*utils.Claims, error) {
+	claims, err := utils.ValidateToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenID, err := claims.TokenID()
+	if err != nil {
+		return nil, errors.New("token has no valid jti")
+	}
+
+	db, err := database.GetDb()
+	if err != nil {
+		log.Printf("Error connecting to the database: %v", err)
+		return nil, errRevocationCheckFailed
+	}
+
+	revoked, err := repository.GetTokenRevocationStore().IsRevoked(ctx, db, tokenID, claims.SessionID)
+	if err != nil {
+		return nil, errRevocationCheckFailed
+	}
+	if revoked {
+		return nil, errors.New("token has been revoked")
+	}
+
+	return claims, nil
+}
+
+func bearerToken(authHeader string) (string, bool) {
+	tokenString := strings.Split(authHeader, "Bearer ")
+	if len(tokenString) != 2 || tokenString[1] == "" {
+		return "", false
+	}
+	return tokenString[1], true
+}
+
+func webSocketToken(r *http.Request) string {
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+		if token, ok := bearerToken(authHeader); ok {
+			return token
+		}
+	}
+
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+
+	protocols := websocketProtocols(r)
+	for i, protocol := range protocols {
+		if protocol == webSocketTokenProtocol && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
+	}
+
+	return ""
+}
+
+func websocketProtocols(r *http.Request) []string {
+	var protocols []string
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
+
+func withClaims(r *http.Request, claims *utils.Claims) *http.Request {
+	tokenID, _ := claims.TokenID()
+
+	ctx := r.Context()
+	ctx = context.WithValue(ctx, "user_id", claims.UserID)
+	ctx = context.WithValue(ctx, "user_uuid", claims.UserUUID)
+	ctx = context.WithValue(ctx, "username", claims.Username)
+	ctx = context.WithValue(ctx, "email", claims.Email)
+	ctx = context.WithValue(ctx, "session_id", claims.SessionID)
+	ctx = context.WithValue(ctx, "token_id", tokenID)
+	ctx = context.WithValue(ctx, "token_expires_at", claims.ExpiresAt.Time)
+	ctx = context.WithValue(ctx, "auth_time", time.Unix(claims.AuthTime, 0))
+	return r.WithContext(ctx)
+}
+
+// withPersonalAccessToken fills the same context values as withClaims. The
+// token UUID stands in for the session, so that revoking the token can close
+// its WebSocket connections like a session's, and auth_time is left zero
+// since a token never counts as a recent login.
+func withPersonalAccessToken(r *http.Request, token *models.PersonalAccessToken, user *models.User) *http.Request {
+	var expiresAt time.Time
+	if token.ExpiresAt != nil {
+		expiresAt = *token.ExpiresAt
+	}
+
+	ctx := r.Context()
+	ctx = context.WithValue(ctx, "user_id", user.ID)
+	ctx = context.WithValue(ctx, "user_uuid", user.UUID)
+	ctx = context.WithValue(ctx, "username", user.Username)
+	ctx = context.WithValue(ctx, "email", user.Email)
+	ctx = context.WithValue(ctx, "session_id", token.UUID)
+	ctx = context.WithValue(ctx, "token_id", token.UUID)
+	ctx = context.WithValue(ctx, "token_expires_at", expiresAt)
+	ctx = context.WithValue(ctx, "auth_time", time.Time{})
+	ctx = context.WithValue(ctx, "token_scopes", token.Scopes)
+	return r.WithContext(ctx)
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/ratelimit"
+	"github.com/AndreaCasaluci/go-chat-app/utils"
+	"github.com/google/uuid"
+)
+
+// RateLimit limits requests to policy, with one bucket per authenticated user
+// or, on routes without authentication, per client IP. Wrap it inside
+// JWTMiddleware so that the user is known. Every response carries the
+// RateLimit-* headers; refused requests get a 429 with Retry-After.
+func RateLimit(policy ratelimit.BucketPolicy) func(http.HandlerFunc) http.HandlerFunc {
+	return rateLimit(policy, rateLimitKey)
+}
+
+// IPRateLimit limits requests to policy per client IP, whether or not the
+// request is authenticated. Wrap it around JWTMiddleware so that requests are
+// counted before their credentials are checked.
+func IPRateLimit(policy ratelimit.BucketPolicy) func(http.HandlerFunc) http.HandlerFunc {
+	return rateLimit(policy, func(r *http.Request, policy ratelimit.BucketPolicy) string {
+		return policy.Name + ":ip:" + utils.ClientIP(r)
+	})
+}
+
+func rateLimit(policy ratelimit.BucketPolicy, key func(*http.Request, ratelimit.BucketPolicy) string) func(http.HandlerFunc) http.HandlerFunc {
+	limiter := ratelimit.GetTokenBucketLimiter()
+
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			decision := limiter.Take(key(r, policy), policy)
+
+			w.Header().Set("RateLimit-Policy", policy.String())
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+			w.Header().Set("RateLimit-Reset", ceilSeconds(decision.Reset))
+
+			if !decision.Allowed {
+				w.Header().Set("Retry-After", ceilSeconds(decision.Reset))
+				http.Error(w, "Too many requests, try again later", http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func rateLimitKey(r *http.Request, policy ratelimit.BucketPolicy) string {
+	if userUUID, ok := r.Context().Value("user_uuid").(uuid.UUID); ok {
+		return policy.Name + ":user:" + userUUID.String()
+	}
+	return policy.Name + ":ip:" + utils.ClientIP(r)
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -1,9 +1,87 @@
 package models
 
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// GroupRole is the role of a member inside a group chat
+type GroupRole string
+
+const (
+	GroupRoleOwner  GroupRole = "owner"
+	GroupRoleAdmin  GroupRole = "admin"
+	GroupRoleMember GroupRole = "member"
+)
+
 // GroupChat represents a group chat
 type GroupChat struct {
-	ID        int64  `json:"id"`
-	Name      string `json:"name"`
-	CreatedBy int64  `json:"created_by"` // User ID who created the group chat
-	CreatedAt string `json:"created_at"`
+	ID               int64     `json:"id"`
+	UUID             uuid.UUID `json:"uuid"`
+	Name             string    `json:"name"`
+	CreatedBy        int64     `json:"created_by"` // User ID who created the group chat
+	CreatedByUUID    uuid.UUID `json:"created_by_uuid"`
+	AnnouncementOnly bool      `json:"announcement_only"` // Only owners and admins can post
+	SlowModeSeconds  int       `json:"slow_mode_seconds"` // Minimum delay between two messages of a member
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// GroupMember represents a user's membership in a group chat
+type GroupMember struct {
+	GroupID  int64     `json:"group_id"`
+	UserID   int64     `json:"user_id"`
+	UserUUID uuid.UUID `json:"user_uuid"`
+	Username string    `json:"username"`
+	Role     GroupRole `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+func (r GroupRole) rank() int {
+	switch r {
+	case GroupRoleOwner:
+		return 2
+	case GroupRoleAdmin:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// CanManageGroup reports whether the role may rename the group and change its settings.
+func (r GroupRole) CanManageGroup() bool {
+	return r.rank() >= GroupRoleAdmin.rank()
+}
+
+// CanDeleteGroup reports whether the role may delete the group.
+func (r GroupRole) CanDeleteGroup() bool {
+	return r == GroupRoleOwner
+}
+
+// CanAddMembers reports whether the role may add new members.
+func (r GroupRole) CanAddMembers() bool {
+	return r.rank() >= GroupRoleAdmin.rank()
+}
+
+// CanRemoveMember reports whether the role may remove a member holding target,
+// which is only allowed for members ranked strictly lower.
+func (r GroupRole) CanRemoveMember(target GroupRole) bool {
+	return r.CanAddMembers() && r.rank() > target.rank()
+}
+
+// CanChangeRoles reports whether the role may promote and demote members.
+func (r GroupRole) CanChangeRoles() bool {
+	return r == GroupRoleOwner
+}
+
+// BypassesSlowMode reports whether the role may post without waiting for the
+// slow mode delay of the group.
+func (r GroupRole) BypassesSlowMode() bool {
+	return r.rank() >= GroupRoleAdmin.rank()
+}
+
+// CanPost reports whether the role may send messages to the group.
+func (r GroupRole) CanPost(group *GroupChat) bool {
+	return !group.AnnouncementOnly || r.rank() >= GroupRoleAdmin.rank()
 }
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Media represents an uploaded object that messages can reference
+type Media struct {
+	ID           int64     `json:"id"`
+	UUID         uuid.UUID `json:"uuid"`
+	OwnerID      int64     `json:"owner_id"`
+	ObjectKey    string    `json:"object_key"`   // Key in the object storage bucket
+	MediaType    string    `json:"media_type"`   // image, video
+	ContentType  string    `json:"content_type"` // Sniffed MIME type
+	SizeBytes    int64     `json:"size_bytes"`
+	Width        int       `json:"width"`         // 0 when unknown
+	Height       int       `json:"height"`        // 0 when unknown
+	ThumbnailKey string    `json:"thumbnail_key"` // Empty when no thumbnail was generated
+	CreatedAt    time.Time `json:"created_at"`
+}
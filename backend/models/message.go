@@ -1,16 +1,25 @@
 package models
 
-import "github.com/google/uuid"
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
 
 // Message represents a message in the system
 type Message struct {
-	ID          int64     `json:"id"`
-	UUID        uuid.UUID `json:"uuid"`
-	SenderID    int64     `json:"sender_id"`
-	ReceiverID  int64     `json:"receiver_id"`
-	GroupID     int64     `json:"group_id"`
-	MessageText string    `json:"message_text"`
-	MediaType   string    `json:"media_type"` // text, image, video
-	MediaURL    string    `json:"media_url"`  // URL for media
-	CreatedAt   string    `json:"created_at"`
+	ID           int64      `json:"id"`
+	UUID         uuid.UUID  `json:"uuid"`
+	SenderID     int64      `json:"sender_id"`
+	SenderUUID   uuid.UUID  `json:"sender_uuid"`
+	ReceiverID   *int64     `json:"receiver_id"`   // Set for direct messages
+	ReceiverUUID *uuid.UUID `json:"receiver_uuid"` // Set for direct messages
+	GroupID      *int64     `json:"group_id"`      // Set for group messages
+	GroupUUID    *uuid.UUID `json:"group_uuid"`    // Set for group messages
+	MessageText  string     `json:"message_text"`
+	MediaType    string     `json:"media_type"` // text, image, video
+	MediaURL     string     `json:"media_url"`  // URL for media
+	MediaID      *int64     `json:"media_id"`   // Set when an uploaded object is attached
+	Media        *Media     `json:"media"`
+	CreatedAt    time.Time  `json:"created_at"`
 }
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// Scopes a personal access token can be granted. Each route that accepts
+// personal access tokens requires some of them; interactive sessions are
+// not limited by scopes.
+const (
+	ScopeMessagesRead  = "messages:read"
+	ScopeMessagesWrite = "messages:write"
+	ScopeGroupsRead    = "groups:read"
+	ScopeGroupsWrite   = "groups:write"
+	ScopeUsersRead     = "users:read"
+)
+
+// PersonalAccessToken is a long lived credential a user mints for bots and
+// scripts. Only the hash of the token is stored.
+type PersonalAccessToken struct {
+	ID         int64      `json:"id"`
+	UUID       uuid.UUID  `json:"uuid"`
+	UserID     int64      `json:"user_id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// HasScope reports whether the token was granted scope.
+func (t *PersonalAccessToken) HasScope(scope string) bool {
+	for _, granted := range t.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/db"
+	"github.com/AndreaCasaluci/go-chat-app/utils"
+)
+
+// Policy decides how long a key is locked out after repeated failures.
+type Policy struct {
+	// Failures tolerated before the first lockout.
+	FreeAttempts int
+	// Lockout after the first failure beyond FreeAttempts; it doubles with
+	// every further failure, up to MaxLockout.
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+	// Failures are forgotten once this long has passed since the last one.
+	Window time.Duration
+}
+
+// Lockout returns how long a key is locked out after its given number of
+// consecutive failures.
+func (p Policy) Lockout(failures int) time.Duration {
+	excess := failures - p.FreeAttempts
+	if excess <= 0 {
+		return 0
+	}
+
+	lockout := p.BaseLockout
+	for i := 1; i < excess && lockout < p.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > p.MaxLockout {
+		lockout = p.MaxLockout
+	}
+	return lockout
+}
+
+// LoginLimiter tracks failed authentication attempts per key, such as an
+// account or a client IP, and locks keys out with exponential backoff.
+//
+// Attempts are counted as failures before they are made, so that concurrent
+// attempts cannot all get in before the first failure is recorded. The
+// caller then gives the attempt back once it is known not to have failed.
+type LoginLimiter interface {
+	// Reserve returns how long key is still locked out, without counting
+	// the attempt. Otherwise it counts the attempt as a failure, locking the
+	// key out for later attempts if that exceeds policy, and returns zero.
+	Reserve(ctx context.Context, key string, policy Policy) (time.Duration, error)
+	// Release takes back an attempt reserved for key that did not fail.
+	Release(ctx context.Context, key string, policy Policy) error
+	// Reset forgets the failures of key, after a successful attempt.
+	Reset(ctx context.Context, key string) error
+}
+
+var loginLimiter LoginLimiter = nil
+
+func newLoginLimiter() (LoginLimiter, error) {
+	config, err := utils.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.RateLimitBackend {
+	case "", "memory":
+		return NewMemoryLoginLimiter(), nil
+	case "postgres":
+		db, err := database.GetDb()
+		if err != nil {
+			return nil, err
+		}
+		return NewPostgresLoginLimiter(db), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit backend %q", config.RateLimitBackend)
+	}
+}
+
+func GetLoginLimiter() (LoginLimiter, error) {
+	if loginLimiter != nil {
+		return loginLimiter, nil
+	}
+
+	limiter, err := newLoginLimiter()
+	if err != nil {
+		return nil, err
+	}
+	loginLimiter = limiter
+	return loginLimiter, nil
+}
@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryLoginLimiter keeps failure counts in process memory. It suits a
+// single instance; with several, each one counts separately and an attacker
+// gets as many attempts per instance, so use PostgresLoginLimiter instead.
+type MemoryLoginLimiter struct {
+	mu        sync.Mutex
+	entries   map[string]*loginEntry
+	lastSweep time.Time
+}
+
+type loginEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+	window      time.Duration
+}
+
+func NewMemoryLoginLimiter() *MemoryLoginLimiter {
+	return &MemoryLoginLimiter{
+		entries:   make(map[string]*loginEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *MemoryLoginLimiter) Reserve(ctx context.Context, key string, policy Policy) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	entry, ok := l.entries[key]
+	if ok {
+		if lockout := remaining(entry.lockedUntil, now); lockout > 0 {
+			return lockout, nil
+		}
+	}
+	if !ok || now.Sub(entry.lastFailure) > policy.Window {
+		entry = &loginEntry{}
+		l.entries[key] = entry
+	}
+
+	entry.failures++
+	entry.lastFailure = now
+	entry.window = policy.Window
+
+	if lockout := policy.Lockout(entry.failures); lockout > 0 {
+		entry.lockedUntil = now.Add(lockout)
+	}
+	return 0, nil
+}
+
+func (l *MemoryLoginLimiter) Release(ctx context.Context, key string, policy Policy) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.entries[key]
+	if !ok || entry.failures == 0 {
+		return nil
+	}
+
+	entry.failures--
+	if policy.Lockout(entry.failures) == 0 {
+		entry.lockedUntil = time.Time{}
+	}
+	return nil
+}
+
+func (l *MemoryLoginLimiter) Reset(ctx context.Context, key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.entries, key)
+	return nil
+}
+
+// sweep drops entries whose failures have been forgotten, at most once per
+// minute. The caller must hold the lock.
+func (l *MemoryLoginLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	for key, entry := range l.entries {
+		if now.Sub(entry.lastFailure) > entry.window && !now.Before(entry.lockedUntil) {
+			delete(l.entries, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+func remaining(until time.Time, now time.Time) time.Duration {
+	if until.After(now) {
+		return until.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,135 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// staleAttemptAge is how long rows are kept after their last failure. It
+// only needs to exceed the longest window of any policy.
+const staleAttemptAge = 24 * time.Hour
+
+// PostgresLoginLimiter keeps failure counts in the login_attempts table, so
+// that every instance of the server enforces the same limits.
+type PostgresLoginLimiter struct {
+	db *sql.DB
+}
+
+func NewPostgresLoginLimiter(db *sql.DB) *PostgresLoginLimiter {
+	return &PostgresLoginLimiter{db: db}
+}
+
+func (l *PostgresLoginLimiter) Reserve(ctx context.Context, key string, policy Policy) (time.Duration, error) {
+	lockout, err := l.reserveTx(ctx, key, policy)
+	if err != nil {
+		return 0, fmt.Errorf("could not record login attempt: %w", err)
+	}
+	return lockout, nil
+}
+
+// reserveTx counts the attempt under a lock on the row of key, so that
+// concurrent attempts see each other's failures.
+func (l *PostgresLoginLimiter) reserveTx(ctx context.Context, key string, policy Policy) (time.Duration, error) {
+	// Timestamps come from this process rather than Postgres so that they
+	// compare consistently with time.Now.
+	now := time.Now().UTC()
+
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+			INSERT INTO login_attempts (key, failures, last_failure_at)
+			VALUES ($1, 0, $2)
+			ON CONFLICT (key) DO NOTHING`,
+		key, now,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var failures int
+	var lastFailure time.Time
+	var lockedUntil sql.NullTime
+	err = tx.QueryRowContext(ctx, "SELECT failures, last_failure_at, locked_until FROM login_attempts WHERE key = $1 FOR UPDATE", key).
+		Scan(&failures, &lastFailure, &lockedUntil)
+	if err != nil {
+		return 0, err
+	}
+
+	if lockedUntil.Valid {
+		if lockout := remaining(lockedUntil.Time, now); lockout > 0 {
+			return lockout, nil
+		}
+	}
+	if now.Sub(lastFailure) > policy.Window {
+		failures = 0
+	}
+	failures++
+
+	if lockout := policy.Lockout(failures); lockout > 0 {
+		lockedUntil = sql.NullTime{Time: now.Add(lockout), Valid: true}
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE login_attempts SET failures = $2, last_failure_at = $3, locked_until = $4 WHERE key = $1",
+		key, failures, now, lockedUntil)
+	if err != nil {
+		return 0, err
+	}
+
+	// Forgotten rows are purged now and then rather than on every attempt.
+	if failures == 1 {
+		_, err = tx.ExecContext(ctx, "DELETE FROM login_attempts WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < $2)", now.Add(-staleAttemptAge), now)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return 0, tx.Commit()
+}
+
+func (l *PostgresLoginLimiter) Release(ctx context.Context, key string, policy Policy) error {
+	if err := l.releaseTx(ctx, key, policy); err != nil {
+		return fmt.Errorf("could not release login attempt: %w", err)
+	}
+	return nil
+}
+
+func (l *PostgresLoginLimiter) releaseTx(ctx context.Context, key string, policy Policy) error {
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var failures int
+	err = tx.QueryRowContext(ctx, "SELECT failures FROM login_attempts WHERE key = $1 FOR UPDATE", key).Scan(&failures)
+	if err == sql.ErrNoRows || (err == nil && failures == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	failures--
+	_, err = tx.ExecContext(ctx, `
+			UPDATE login_attempts
+			SET failures = $2, locked_until = CASE WHEN $3 THEN NULL ELSE locked_until END
+			WHERE key = $1`,
+		key, failures, policy.Lockout(failures) == 0,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (l *PostgresLoginLimiter) Reset(ctx context.Context, key string) error {
+	if _, err := l.db.ExecContext(ctx, "DELETE FROM login_attempts WHERE key = $1", key); err != nil {
+		return fmt.Errorf("could not reset login attempts: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package ratelimit
+
+import "github.com/AndreaCasaluci/go-chat-app/utils"
+
+const (
+	defaultAuthRateLimit         = "10/1m"
+	defaultWriteRateLimit        = "60/1m"
+	defaultReadRateLimit         = "300/1m"
+	defaultIPRateLimit           = "600/1m"
+	defaultWSConnectionRateLimit = "20/10s"
+	defaultWSUserRateLimit       = "40/10s"
+)
+
+// RoutePolicies groups the policies applied to each kind of route.
+type RoutePolicies struct {
+	// Auth covers unauthenticated endpoints that create accounts, check
+	// credentials or send email.
+	Auth BucketPolicy
+	// Write covers authenticated requests that change state.
+	Write BucketPolicy
+	// Read covers authenticated requests that only read.
+	Read BucketPolicy
+	// IP covers every authenticated request per client IP, checked before
+	// the credentials so that requests with invalid tokens are limited too.
+	IP BucketPolicy
+	// WSConnection and WSUser cover the frames sent over a single WebSocket
+	// connection and over all the connections of one user.
+	WSConnection BucketPolicy
+	WSUser       BucketPolicy
+}
+
+var routePolicies *RoutePolicies = nil
+
+func loadRoutePolicies() (*RoutePolicies, error) {
+	config, err := utils.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	policies := &RoutePolicies{}
+	settings := []struct {
+		policy   *BucketPolicy
+		name     string
+		spec     string
+		fallback string
+	}{
+		{&policies.Auth, "auth", config.RateLimitAuth, defaultAuthRateLimit},
+		{&policies.Write, "write", config.RateLimitWrite, defaultWriteRateLimit},
+		{&policies.Read, "read", config.RateLimitRead, defaultReadRateLimit},
+		{&policies.IP, "ip", config.RateLimitIP, defaultIPRateLimit},
+		{&policies.WSConnection, "ws_connection", config.RateLimitWSConnection, defaultWSConnectionRateLimit},
+		{&policies.WSUser, "ws_user", config.RateLimitWSUser, defaultWSUserRateLimit},
+	}
+
+	for _, setting := range settings {
+		spec := setting.spec
+		if spec == "" {
+			spec = setting.fallback
+		}
+		policy, err := ParseBucketPolicy(setting.name, spec)
+		if err != nil {
+			return nil, err
+		}
+		*setting.policy = policy
+	}
+
+	return policies, nil
+}
+
+// GetRoutePolicies returns the policies read from the RATE_LIMIT_* settings,
+// falling back to defaults for those left empty.
+func GetRoutePolicies() (*RoutePolicies, error) {
+	if routePolicies != nil {
+		return routePolicies, nil
+	}
+
+	policies, err := loadRoutePolicies()
+	if err != nil {
+		return nil, err
+	}
+	routePolicies = policies
+	return routePolicies, nil
+}
@@ -0,0 +1,133 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BucketPolicy allows Limit requests per Period, refilled continuously, with
+// bursts of up to Limit requests.
+type BucketPolicy struct {
+	Name   string
+	Limit  int
+	Period time.Duration
+}
+
+// ParseBucketPolicy reads a policy written as "<limit>/<period>", such as
+// "60/1m".
+func ParseBucketPolicy(name, spec string) (BucketPolicy, error) {
+	limit, period, ok := strings.Cut(strings.TrimSpace(spec), "/")
+	if !ok {
+		return BucketPolicy{}, fmt.Errorf("invalid rate limit %q for %s: expected <limit>/<period>", spec, name)
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(limit))
+	if err != nil || n <= 0 {
+		return BucketPolicy{}, fmt.Errorf("invalid rate limit %q for %s: limit must be a positive integer", spec, name)
+	}
+
+	d, err := time.ParseDuration(strings.TrimSpace(period))
+	if err != nil || d <= 0 {
+		return BucketPolicy{}, fmt.Errorf("invalid rate limit %q for %s: period must be a positive duration", spec, name)
+	}
+
+	return BucketPolicy{Name: name, Limit: n, Period: d}, nil
+}
+
+// String formats the policy for the RateLimit-Policy header.
+func (p BucketPolicy) String() string {
+	return fmt.Sprintf("%d;w=%d", p.Limit, int(math.Ceil(p.Period.Seconds())))
+}
+
+// rate returns how many tokens the policy refills per second.
+func (p BucketPolicy) rate() float64 {
+	return float64(p.Limit) / p.Period.Seconds()
+}
+
+// Decision is the outcome of taking a token from a bucket.
+type Decision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again or, when the
+	// request was refused, until the next token is available.
+	Reset time.Duration
+}
+
+// TokenBucketLimiter keeps one token bucket per key in memory.
+type TokenBucketLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	period  time.Duration
+}
+
+func NewTokenBucketLimiter() *TokenBucketLimiter {
+	return &TokenBucketLimiter{
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Take takes a token from the bucket of key, creating a full one if needed.
+func (l *TokenBucketLimiter) Take(key string, policy BucketPolicy) Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(policy.Limit), updated: now, period: policy.Period}
+		l.buckets[key] = b
+	}
+
+	rate := policy.rate()
+	b.tokens = math.Min(float64(policy.Limit), b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+
+	decision := Decision{Limit: policy.Limit}
+	if b.tokens >= 1 {
+		b.tokens--
+		decision.Allowed = true
+		decision.Reset = secondsToDuration((float64(policy.Limit) - b.tokens) / rate)
+	} else {
+		decision.Reset = secondsToDuration((1 - b.tokens) / rate)
+	}
+	decision.Remaining = int(math.Floor(b.tokens))
+	return decision
+}
+
+// sweep drops buckets that have had time to refill completely, at most once
+// per minute. The caller must hold the lock.
+func (l *TokenBucketLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) >= b.period {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+var tokenBucketLimiter = NewTokenBucketLimiter()
+
+func GetTokenBucketLimiter() *TokenBucketLimiter {
+	return tokenBucketLimiter
+}
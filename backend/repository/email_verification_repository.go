@@ -0,0 +1,121 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	ErrUserAlreadyVerified        = errors.New("user already verified")
+	ErrVerificationEmailThrottled = errors.New("verification email sent too recently")
+)
+
+// MarkUserVerified flags the user as verified provided their address is still
+// email, and reports whether it was.
+func MarkUserVerified(ctx context.Context, db *sql.DB, userID int64, email string) (bool, error) {
+	resultChan := make(chan struct {
+		verified bool
+		err      error
+	}, 1)
+
+	go func() {
+		result, err := db.ExecContext(ctx, `
+				UPDATE users SET verified = TRUE, updated_at = CURRENT_TIMESTAMP
+				WHERE id = $1 AND email = $2`,
+			userID, email,
+		)
+		var rowsAffected int64
+		if err == nil {
+			rowsAffected, err = result.RowsAffected()
+		}
+		resultChan <- struct {
+			verified bool
+			err      error
+		}{verified: rowsAffected > 0, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			log.Printf("Error verifying user: %v", result.err)
+			return false, fmt.Errorf("could not verify user: %w", result.err)
+		}
+		return result.verified, nil
+	case <-ctx.Done():
+		return false, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+// ReserveVerificationEmail records that a verification email is about to be
+// sent to an unverified user, unless one was already sent within interval. In
+// that case ErrVerificationEmailThrottled is returned together with how long
+// the caller has to wait.
+func ReserveVerificationEmail(ctx context.Context, db *sql.DB, userID int64, interval time.Duration) (time.Duration, error) {
+	resultChan := make(chan struct {
+		retryAfter time.Duration
+		err        error
+	}, 1)
+
+	go func() {
+		retryAfter, err := reserveVerificationEmail(ctx, db, userID, interval)
+		resultChan <- struct {
+			retryAfter time.Duration
+			err        error
+		}{retryAfter: retryAfter, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			if errors.Is(result.err, ErrUserAlreadyVerified) || errors.Is(result.err, ErrVerificationEmailThrottled) || errors.Is(result.err, ErrUserNotFound) {
+				return result.retryAfter, result.err
+			}
+			log.Printf("Error reserving verification email: %v", result.err)
+			return 0, fmt.Errorf("could not reserve verification email: %w", result.err)
+		}
+		return 0, nil
+	case <-ctx.Done():
+		return 0, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func reserveVerificationEmail(ctx context.Context, db *sql.DB, userID int64, interval time.Duration) (time.Duration, error) {
+	result, err := db.ExecContext(ctx, `
+			UPDATE users SET verification_sent_at = CURRENT_TIMESTAMP
+			WHERE id = $1 AND verified = FALSE
+			AND (verification_sent_at IS NULL OR verification_sent_at <= CURRENT_TIMESTAMP - $2 * INTERVAL '1 second')`,
+		userID, interval.Seconds(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if rowsAffected > 0 {
+		return 0, nil
+	}
+
+	var verified bool
+	var waitSeconds sql.NullFloat64
+	err = db.QueryRowContext(ctx, `
+			SELECT verified, EXTRACT(EPOCH FROM verification_sent_at + $2 * INTERVAL '1 second' - CURRENT_TIMESTAMP)
+			FROM users WHERE id = $1`,
+		userID, interval.Seconds(),
+	).Scan(&verified, &waitSeconds)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrUserNotFound
+		}
+		return 0, err
+	}
+	if verified {
+		return 0, ErrUserAlreadyVerified
+	}
+	return time.Duration(waitSeconds.Float64 * float64(time.Second)), ErrVerificationEmailThrottled
+}
@@ -0,0 +1,590 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/AndreaCasaluci/go-chat-app/models"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrGroupNotFound      = errors.New("group not found")
+	ErrAlreadyGroupMember = errors.New("user is already a member of the group")
+	ErrNotGroupMember     = errors.New("user is not a member of the group")
+	ErrInvalidGroupRole   = errors.New("invalid group role")
+)
+
+type CreateGroupParams struct {
+	Name      string
+	CreatedBy int64
+	MemberIDs []int64
+}
+
+type UpdateGroupParams struct {
+	GroupID          int64
+	Name             *string
+	AnnouncementOnly *bool
+	SlowModeSeconds  *int
+}
+
+// LeaveGroupResult describes the side effects of a member leaving a group.
+type LeaveGroupResult struct {
+	GroupDeleted bool
+	NewOwnerID   *int64
+}
+
+const selectGroupQuery = `
+	SELECT g.id, g.uuid, g.name, g.created_by, u.uuid, g.announcement_only, g.slow_mode_seconds, g.created_at, g.updated_at
+	FROM group_chats g
+	JOIN users u ON u.id = g.created_by`
+
+func scanGroup(scanner rowScanner) (*models.GroupChat, error) {
+	var group models.GroupChat
+	err := scanner.Scan(&group.ID, &group.UUID, &group.Name, &group.CreatedBy, &group.CreatedByUUID, &group.AnnouncementOnly, &group.SlowModeSeconds, &group.CreatedAt, &group.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+func CreateGroup(ctx context.Context, db *sql.DB, params CreateGroupParams) (*models.GroupChat, error) {
+	resultChan := make(chan struct {
+		group *models.GroupChat
+		err   error
+	}, 1)
+
+	go func() {
+		group, err := createGroupTx(ctx, db, params)
+		resultChan <- struct {
+			group *models.GroupChat
+			err   error
+		}{group: group, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			log.Printf("Error creating group: %v", result.err)
+			return nil, fmt.Errorf("could not create group: %w", result.err)
+		}
+		return result.group, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func createGroupTx(ctx context.Context, db *sql.DB, params CreateGroupParams) (*models.GroupChat, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var groupID int64
+	err = tx.QueryRowContext(ctx, `
+			INSERT INTO group_chats (uuid, name, created_by)
+			VALUES (uuid_generate_v4(), $1, $2)
+			RETURNING id`,
+		params.Name, params.CreatedBy,
+	).Scan(&groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+			INSERT INTO group_chat_members (group_id, user_id, role)
+			VALUES ($1, $2, $3)`,
+		groupID, params.CreatedBy, models.GroupRoleOwner,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, memberID := range params.MemberIDs {
+		_, err = tx.ExecContext(ctx, `
+				INSERT INTO group_chat_members (group_id, user_id, role)
+				VALUES ($1, $2, $3)
+				ON CONFLICT (group_id, user_id) DO NOTHING`,
+			groupID, memberID, models.GroupRoleMember,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	group, err := scanGroup(tx.QueryRowContext(ctx, selectGroupQuery+" WHERE g.id = $1", groupID))
+	if err != nil {
+		return nil, err
+	}
+
+	return group, tx.Commit()
+}
+
+func GetGroupByUUID(ctx context.Context, db *sql.DB, groupUUID uuid.UUID) (*models.GroupChat, error) {
+	groupChan := make(chan *models.GroupChat, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		group, err := scanGroup(db.QueryRowContext(ctx, selectGroupQuery+" WHERE g.uuid = $1", groupUUID))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				errChan <- ErrGroupNotFound
+			} else {
+				errChan <- fmt.Errorf("error querying group: %v", err)
+			}
+			return
+		}
+
+		groupChan <- group
+	}()
+
+	select {
+	case group := <-groupChan:
+		return group, nil
+	case err := <-errChan:
+		return nil, err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func ListUserGroups(ctx context.Context, db *sql.DB, userID int64) ([]models.GroupChat, error) {
+	resultChan := make(chan struct {
+		groups []models.GroupChat
+		err    error
+	}, 1)
+
+	go func() {
+		groups := []models.GroupChat{}
+		rows, err := db.QueryContext(ctx, selectGroupQuery+`
+			JOIN group_chat_members m ON m.group_id = g.id
+			WHERE m.user_id = $1
+			ORDER BY g.updated_at DESC, g.id DESC`, userID)
+		if err != nil {
+			resultChan <- struct {
+				groups []models.GroupChat
+				err    error
+			}{err: err}
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			group, err := scanGroup(rows)
+			if err != nil {
+				resultChan <- struct {
+					groups []models.GroupChat
+					err    error
+				}{err: err}
+				return
+			}
+			groups = append(groups, *group)
+		}
+
+		resultChan <- struct {
+			groups []models.GroupChat
+			err    error
+		}{groups: groups, err: rows.Err()}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			return nil, fmt.Errorf("could not list groups: %w", result.err)
+		}
+		return result.groups, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func UpdateGroup(ctx context.Context, db *sql.DB, params UpdateGroupParams) (*models.GroupChat, error) {
+	groupChan := make(chan *models.GroupChat, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		query := `UPDATE group_chats SET updated_at=CURRENT_TIMESTAMP`
+		args := []interface{}{}
+		argCount := 1
+
+		if params.Name != nil {
+			query += fmt.Sprintf(", name=$%d", argCount)
+			args = append(args, *params.Name)
+			argCount++
+		}
+
+		if params.AnnouncementOnly != nil {
+			query += fmt.Sprintf(", announcement_only=$%d", argCount)
+			args = append(args, *params.AnnouncementOnly)
+			argCount++
+		}
+
+		if params.SlowModeSeconds != nil {
+			query += fmt.Sprintf(", slow_mode_seconds=$%d", argCount)
+			args = append(args, *params.SlowModeSeconds)
+			argCount++
+		}
+
+		query += fmt.Sprintf(" WHERE id=$%d", argCount)
+		args = append(args, params.GroupID)
+
+		result, err := db.ExecContext(ctx, query, args...)
+		if err != nil {
+			errChan <- fmt.Errorf("could not update group: %v", err)
+			return
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			errChan <- ErrGroupNotFound
+			return
+		}
+
+		group, err := scanGroup(db.QueryRowContext(ctx, selectGroupQuery+" WHERE g.id = $1", params.GroupID))
+		if err != nil {
+			errChan <- fmt.Errorf("could not load group: %v", err)
+			return
+		}
+
+		groupChan <- group
+	}()
+
+	select {
+	case group := <-groupChan:
+		return group, nil
+	case err := <-errChan:
+		return nil, err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+// DeleteGroup removes a group; its memberships and messages are removed by
+// the ON DELETE CASCADE foreign keys.
+func DeleteGroup(ctx context.Context, db *sql.DB, groupID int64) error {
+	errChan := make(chan error, 1)
+
+	go func() {
+		result, err := db.ExecContext(ctx, "DELETE FROM group_chats WHERE id = $1", groupID)
+		if err != nil {
+			errChan <- fmt.Errorf("could not delete group: %v", err)
+			return
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			errChan <- ErrGroupNotFound
+			return
+		}
+		errChan <- nil
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+const selectGroupMemberQuery = `
+	SELECT m.group_id, m.user_id, u.uuid, u.username, m.role, m.created_at
+	FROM group_chat_members m
+	JOIN users u ON u.id = m.user_id`
+
+func scanGroupMember(scanner rowScanner) (*models.GroupMember, error) {
+	var member models.GroupMember
+	err := scanner.Scan(&member.GroupID, &member.UserID, &member.UserUUID, &member.Username, &member.Role, &member.JoinedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+func GetGroupMember(ctx context.Context, db *sql.DB, groupID, userID int64) (*models.GroupMember, error) {
+	memberChan := make(chan *models.GroupMember, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		member, err := scanGroupMember(db.QueryRowContext(ctx, selectGroupMemberQuery+" WHERE m.group_id = $1 AND m.user_id = $2", groupID, userID))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				errChan <- ErrNotGroupMember
+			} else {
+				errChan <- fmt.Errorf("error checking group membership: %v", err)
+			}
+			return
+		}
+
+		memberChan <- member
+	}()
+
+	select {
+	case member := <-memberChan:
+		return member, nil
+	case err := <-errChan:
+		return nil, err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func ListGroupMembers(ctx context.Context, db *sql.DB, groupID int64) ([]models.GroupMember, error) {
+	resultChan := make(chan struct {
+		members []models.GroupMember
+		err     error
+	}, 1)
+
+	go func() {
+		members := []models.GroupMember{}
+		rows, err := db.QueryContext(ctx, selectGroupMemberQuery+" WHERE m.group_id = $1 ORDER BY m.created_at, m.user_id", groupID)
+		if err != nil {
+			resultChan <- struct {
+				members []models.GroupMember
+				err     error
+			}{err: err}
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			member, err := scanGroupMember(rows)
+			if err != nil {
+				resultChan <- struct {
+					members []models.GroupMember
+					err     error
+				}{err: err}
+				return
+			}
+			members = append(members, *member)
+		}
+
+		resultChan <- struct {
+			members []models.GroupMember
+			err     error
+		}{members: members, err: rows.Err()}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			return nil, fmt.Errorf("could not list group members: %w", result.err)
+		}
+		return result.members, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func AddGroupMember(ctx context.Context, db *sql.DB, groupID, userID int64) error {
+	errChan := make(chan error, 1)
+
+	go func() {
+		result, err := db.ExecContext(ctx, `
+				INSERT INTO group_chat_members (group_id, user_id, role)
+				VALUES ($1, $2, $3)
+				ON CONFLICT (group_id, user_id) DO NOTHING`,
+			groupID, userID, models.GroupRoleMember,
+		)
+		if err != nil {
+			errChan <- fmt.Errorf("could not add group member: %v", err)
+			return
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			errChan <- ErrAlreadyGroupMember
+			return
+		}
+		errChan <- nil
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func RemoveGroupMember(ctx context.Context, db *sql.DB, groupID, userID int64) error {
+	errChan := make(chan error, 1)
+
+	go func() {
+		result, err := db.ExecContext(ctx, "DELETE FROM group_chat_members WHERE group_id = $1 AND user_id = $2", groupID, userID)
+		if err != nil {
+			errChan <- fmt.Errorf("could not remove group member: %v", err)
+			return
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			errChan <- ErrNotGroupMember
+			return
+		}
+		errChan <- nil
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func UpdateGroupMemberRole(ctx context.Context, db *sql.DB, groupID, userID int64, role models.GroupRole) error {
+	errChan := make(chan error, 1)
+
+	go func() {
+		// Ownership only changes hands through TransferGroupOwnership.
+		if role != models.GroupRoleAdmin && role != models.GroupRoleMember {
+			errChan <- ErrInvalidGroupRole
+			return
+		}
+
+		result, err := db.ExecContext(ctx, "UPDATE group_chat_members SET role = $1 WHERE group_id = $2 AND user_id = $3 AND role <> $4",
+			role, groupID, userID, models.GroupRoleOwner)
+		if err != nil {
+			errChan <- fmt.Errorf("could not update group member role: %v", err)
+			return
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			errChan <- ErrNotGroupMember
+			return
+		}
+		errChan <- nil
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+// TransferGroupOwnership makes newOwnerID the owner of the group and demotes
+// the current owner to admin.
+func TransferGroupOwnership(ctx context.Context, db *sql.DB, groupID, ownerID, newOwnerID int64) error {
+	errChan := make(chan error, 1)
+
+	go func() {
+		errChan <- transferGroupOwnershipTx(ctx, db, groupID, ownerID, newOwnerID)
+	}()
+
+	select {
+	case err := <-errChan:
+		if err != nil && !errors.Is(err, ErrNotGroupMember) {
+			return fmt.Errorf("could not transfer group ownership: %w", err)
+		}
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func transferGroupOwnershipTx(ctx context.Context, db *sql.DB, groupID, ownerID, newOwnerID int64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "UPDATE group_chat_members SET role = $1 WHERE group_id = $2 AND user_id = $3 AND role = $4",
+		models.GroupRoleAdmin, groupID, ownerID, models.GroupRoleOwner)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrNotGroupMember
+	}
+
+	result, err = tx.ExecContext(ctx, "UPDATE group_chat_members SET role = $1 WHERE group_id = $2 AND user_id = $3",
+		models.GroupRoleOwner, groupID, newOwnerID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrNotGroupMember
+	}
+
+	return tx.Commit()
+}
+
+// LeaveGroup removes a member from a group. When the owner leaves, ownership
+// passes to the longest-standing admin, or failing that the longest-standing
+// member; a group left without members is deleted.
+func LeaveGroup(ctx context.Context, db *sql.DB, groupID, userID int64) (*LeaveGroupResult, error) {
+	resultChan := make(chan struct {
+		result *LeaveGroupResult
+		err    error
+	}, 1)
+
+	go func() {
+		result, err := leaveGroupTx(ctx, db, groupID, userID)
+		resultChan <- struct {
+			result *LeaveGroupResult
+			err    error
+		}{result: result, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil && !errors.Is(result.err, ErrNotGroupMember) {
+			log.Printf("Error leaving group: %v", result.err)
+			return nil, fmt.Errorf("could not leave group: %w", result.err)
+		}
+		return result.result, result.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func leaveGroupTx(ctx context.Context, db *sql.DB, groupID, userID int64) (*LeaveGroupResult, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Serialize concurrent departures so two owners can never be elected.
+	if _, err := tx.ExecContext(ctx, "SELECT id FROM group_chats WHERE id = $1 FOR UPDATE", groupID); err != nil {
+		return nil, err
+	}
+
+	var role models.GroupRole
+	err = tx.QueryRowContext(ctx, "DELETE FROM group_chat_members WHERE group_id = $1 AND user_id = $2 RETURNING role", groupID, userID).
+		Scan(&role)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotGroupMember
+		}
+		return nil, err
+	}
+
+	result := &LeaveGroupResult{}
+
+	var successorID int64
+	err = tx.QueryRowContext(ctx, `
+			SELECT user_id FROM group_chat_members
+			WHERE group_id = $1
+			ORDER BY CASE role WHEN 'admin' THEN 0 ELSE 1 END, created_at, user_id
+			LIMIT 1`,
+		groupID,
+	).Scan(&successorID)
+
+	switch {
+	case err == sql.ErrNoRows:
+		if _, err := tx.ExecContext(ctx, "DELETE FROM group_chats WHERE id = $1", groupID); err != nil {
+			return nil, err
+		}
+		result.GroupDeleted = true
+	case err != nil:
+		return nil, err
+	case role == models.GroupRoleOwner:
+		if _, err := tx.ExecContext(ctx, "UPDATE group_chat_members SET role = $1 WHERE group_id = $2 AND user_id = $3",
+			models.GroupRoleOwner, groupID, successorID); err != nil {
+			return nil, err
+		}
+		result.NewOwnerID = &successorID
+	}
+
+	return result, tx.Commit()
+}
@@ -0,0 +1,168 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/models"
+)
+
+// ErrIdentityEmailConflict is returned when an external identity has no
+// account yet but its email belongs to a local account that cannot safely be
+// linked to it automatically.
+var ErrIdentityEmailConflict = errors.New("an account with this email already exists")
+
+// Attempts at finding a free username for an account created from an
+// external identity before giving up.
+const maxUsernameAttempts = 5
+
+type ExternalIdentityParams struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	// Username is the preferred username of a new account; a numeric
+	// suffix is appended when it is taken.
+	Username string
+	// HashedPassword is stored on a new account. It should be the hash of a
+	// random secret nobody knows; the user can set a real password through
+	// the password reset flow.
+	HashedPassword string
+}
+
+// ExternalLoginResult is the local user behind an external identity and
+// whether the account or the link was created by this login.
+type ExternalLoginResult struct {
+	User    *models.User
+	Created bool
+	Linked  bool
+}
+
+// LoginWithExternalIdentity returns the user linked to the identity. An
+// identity seen for the first time is linked to the local account with the
+// same email when both the issuer and this server verified that email, and
+// otherwise gets a new account; any other email match is refused with
+// ErrIdentityEmailConflict, since linking it would hand the account to
+// whoever controls either side.
+func LoginWithExternalIdentity(ctx context.Context, db *sql.DB, params ExternalIdentityParams) (*ExternalLoginResult, error) {
+	resultChan := make(chan struct {
+		result *ExternalLoginResult
+		err    error
+	}, 1)
+
+	go func() {
+		result, err := loginWithExternalIdentityTx(ctx, db, params)
+		resultChan <- struct {
+			result *ExternalLoginResult
+			err    error
+		}{result: result, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			if errors.Is(result.err, ErrIdentityEmailConflict) {
+				return nil, result.err
+			}
+			log.Printf("Error logging in with external identity: %v", result.err)
+			return nil, fmt.Errorf("could not log in with external identity: %w", result.err)
+		}
+		return result.result, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func loginWithExternalIdentityTx(ctx context.Context, db *sql.DB, params ExternalIdentityParams) (*ExternalLoginResult, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	const selectUser = `
+		SELECT u.id, u.uuid, u.username, u.email, u.verified, u.totp_enabled, u.created_at, u.updated_at
+		FROM users u`
+
+	var user models.User
+	err = tx.QueryRowContext(ctx, selectUser+`
+			JOIN user_identities i ON i.user_id = u.id
+			WHERE i.provider = $1 AND i.subject = $2`,
+		params.Provider, params.Subject,
+	).Scan(&user.ID, &user.UUID, &user.Username, &user.Email, &user.Verified, &user.TOTPEnabled, &user.CreatedAt, &user.UpdatedAt)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `
+				UPDATE user_identities SET email = $3, last_login_at = $4
+				WHERE provider = $1 AND subject = $2`,
+			params.Provider, params.Subject, params.Email, time.Now().UTC(),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return &ExternalLoginResult{User: &user}, tx.Commit()
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	result := &ExternalLoginResult{User: &user}
+
+	err = tx.QueryRowContext(ctx, selectUser+" WHERE LOWER(u.email) = LOWER($1) FOR UPDATE", params.Email).
+		Scan(&user.ID, &user.UUID, &user.Username, &user.Email, &user.Verified, &user.TOTPEnabled, &user.CreatedAt, &user.UpdatedAt)
+	switch {
+	case err == nil:
+		if !params.EmailVerified || !user.Verified {
+			return nil, ErrIdentityEmailConflict
+		}
+		result.Linked = true
+	case err == sql.ErrNoRows:
+		if err := createExternalUserTx(ctx, tx, params, &user); err != nil {
+			return nil, err
+		}
+		result.Created = true
+	default:
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+			INSERT INTO user_identities (user_id, provider, subject, email, created_at, last_login_at)
+			VALUES ($1, $2, $3, $4, $5, $5)`,
+		user.ID, params.Provider, params.Subject, params.Email, time.Now().UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, tx.Commit()
+}
+
+func createExternalUserTx(ctx context.Context, tx *sql.Tx, params ExternalIdentityParams, user *models.User) error {
+	username := params.Username
+	for attempt := 0; ; attempt++ {
+		var taken bool
+		err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(username) = LOWER($1))", username).Scan(&taken)
+		if err != nil {
+			return err
+		}
+		if !taken {
+			break
+		}
+		if attempt == maxUsernameAttempts {
+			return fmt.Errorf("no free username found for %q", params.Username)
+		}
+		username = fmt.Sprintf("%s_%04d", params.Username, rand.IntN(10000))
+	}
+
+	now := time.Now().UTC()
+	return tx.QueryRowContext(ctx, `
+			INSERT INTO users (uuid, username, email, password, verified, created_at, updated_at)
+			VALUES (uuid_generate_v4(), $1, $2, $3, $4, $5, $5)
+			RETURNING id, uuid, username, email, verified, totp_enabled, created_at, updated_at`,
+		username, params.Email, params.HashedPassword, params.EmailVerified, now,
+	).Scan(&user.ID, &user.UUID, &user.Username, &user.Email, &user.Verified, &user.TOTPEnabled, &user.CreatedAt, &user.UpdatedAt)
+}
@@ -0,0 +1,106 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/AndreaCasaluci/go-chat-app/models"
+	"github.com/google/uuid"
+)
+
+var ErrMediaNotFound = errors.New("media not found")
+
+type CreateMediaParams struct {
+	UUID         uuid.UUID
+	OwnerID      int64
+	ObjectKey    string
+	MediaType    string
+	ContentType  string
+	SizeBytes    int64
+	Width        int
+	Height       int
+	ThumbnailKey string
+}
+
+const selectMediaQuery = `
+	SELECT id, uuid, owner_id, object_key, media_type, content_type, size_bytes, width, height, thumbnail_key, created_at
+	FROM media`
+
+func scanMedia(scanner rowScanner) (*models.Media, error) {
+	var media models.Media
+	var width, height sql.NullInt64
+	var thumbnailKey sql.NullString
+	err := scanner.Scan(&media.ID, &media.UUID, &media.OwnerID, &media.ObjectKey, &media.MediaType, &media.ContentType, &media.SizeBytes,
+		&width, &height, &thumbnailKey, &media.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	media.Width = int(width.Int64)
+	media.Height = int(height.Int64)
+	media.ThumbnailKey = thumbnailKey.String
+	return &media, nil
+}
+
+func CreateMedia(ctx context.Context, db *sql.DB, params CreateMediaParams) (*models.Media, error) {
+	resultChan := make(chan struct {
+		media *models.Media
+		err   error
+	}, 1)
+
+	go func() {
+		media, err := scanMedia(db.QueryRowContext(ctx, `
+				INSERT INTO media (uuid, owner_id, object_key, media_type, content_type, size_bytes, width, height, thumbnail_key)
+				VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, 0), NULLIF($8, 0), NULLIF($9, ''))
+				RETURNING id, uuid, owner_id, object_key, media_type, content_type, size_bytes, width, height, thumbnail_key, created_at`,
+			params.UUID, params.OwnerID, params.ObjectKey, params.MediaType, params.ContentType, params.SizeBytes,
+			params.Width, params.Height, params.ThumbnailKey,
+		))
+
+		resultChan <- struct {
+			media *models.Media
+			err   error
+		}{media: media, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			log.Printf("Error inserting media: %v", result.err)
+			return nil, fmt.Errorf("could not create media: %w", result.err)
+		}
+		return result.media, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func GetMediaByUUID(ctx context.Context, db *sql.DB, mediaUUID uuid.UUID) (*models.Media, error) {
+	mediaChan := make(chan *models.Media, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		media, err := scanMedia(db.QueryRowContext(ctx, selectMediaQuery+" WHERE uuid = $1", mediaUUID))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				errChan <- ErrMediaNotFound
+			} else {
+				errChan <- fmt.Errorf("error querying media: %v", err)
+			}
+			return
+		}
+
+		mediaChan <- media
+	}()
+
+	select {
+	case media := <-mediaChan:
+		return media, nil
+	case err := <-errChan:
+		return nil, err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
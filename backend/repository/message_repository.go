@@ -0,0 +1,414 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/models"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrInvalidCursor   = errors.New("invalid cursor")
+	ErrMessageNotFound = errors.New("message not found")
+)
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// MessageCursor identifies a position in a message timeline. Messages are
+// ordered by (created_at, id) so the position stays stable even when several
+// messages share the same timestamp.
+type MessageCursor struct {
+	CreatedAt time.Time
+	ID        int64
+}
+
+type CreateMessageParams struct {
+	SenderID     int64
+	SenderUUID   uuid.UUID
+	ReceiverID   *int64
+	ReceiverUUID *uuid.UUID
+	GroupID      *int64
+	GroupUUID    *uuid.UUID
+	MessageText  string
+	MediaType    string
+	MediaURL     string
+	Media        *models.Media
+}
+
+const selectMessageQuery = `
+	SELECT m.id, m.uuid, m.sender_id, s.uuid, m.receiver_id, r.uuid, m.group_id, g.uuid,
+		m.message_text, m.media_type, m.media_url, m.created_at,
+		md.id, md.uuid, md.owner_id, md.object_key, md.media_type, md.content_type, md.size_bytes,
+		md.width, md.height, md.thumbnail_key, md.created_at
+	FROM messages m
+	JOIN users s ON s.id = m.sender_id
+	LEFT JOIN users r ON r.id = m.receiver_id
+	LEFT JOIN group_chats g ON g.id = m.group_id
+	LEFT JOIN media md ON md.id = m.media_id`
+
+func CreateMessage(ctx context.Context, db *sql.DB, params CreateMessageParams) (*models.Message, error) {
+	resultChan := make(chan struct {
+		message *models.Message
+		err     error
+	}, 1)
+
+	go func() {
+		message, err := insertMessage(ctx, db, params)
+		resultChan <- struct {
+			message *models.Message
+			err     error
+		}{message: message, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			log.Printf("Error inserting message: %v", result.err)
+			return nil, fmt.Errorf("could not create message: %w", result.err)
+		}
+		return result.message, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+// CreateGroupMessage stores a message in the group params.GroupID unless the
+// group's slow mode still holds the sender back, in which case it stores
+// nothing and returns how long the sender must wait. The check and the insert
+// run under a lock on the sender's membership row, so concurrent connections
+// of the same user cannot both get a message in within one delay. It returns
+// ErrNotGroupMember when the sender has left the group.
+func CreateGroupMessage(ctx context.Context, db *sql.DB, params CreateMessageParams, slowMode time.Duration) (*models.Message, time.Duration, error) {
+	resultChan := make(chan struct {
+		message *models.Message
+		wait    time.Duration
+		err     error
+	}, 1)
+
+	go func() {
+		message, wait, err := createGroupMessageTx(ctx, db, params, slowMode)
+		resultChan <- struct {
+			message *models.Message
+			wait    time.Duration
+			err     error
+		}{message: message, wait: wait, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil && !errors.Is(result.err, ErrNotGroupMember) {
+			log.Printf("Error inserting group message: %v", result.err)
+			return nil, 0, fmt.Errorf("could not create message: %w", result.err)
+		}
+		return result.message, result.wait, result.err
+	case <-ctx.Done():
+		return nil, 0, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func createGroupMessageTx(ctx context.Context, db *sql.DB, params CreateMessageParams, slowMode time.Duration) (*models.Message, time.Duration, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	var locked int
+	err = tx.QueryRowContext(ctx, "SELECT 1 FROM group_chat_members WHERE group_id = $1 AND user_id = $2 FOR UPDATE",
+		*params.GroupID, params.SenderID).Scan(&locked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, 0, ErrNotGroupMember
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if slowMode > 0 {
+		// clock_timestamp rather than CURRENT_TIMESTAMP, which is frozen at
+		// the start of the transaction, before the lock was granted.
+		var seconds float64
+		err := tx.QueryRowContext(ctx, `
+				SELECT COALESCE(EXTRACT(EPOCH FROM MAX(created_at) + make_interval(secs => $3) - clock_timestamp()), 0)
+				FROM messages
+				WHERE group_id = $1 AND sender_id = $2`,
+			*params.GroupID, params.SenderID, slowMode.Seconds(),
+		).Scan(&seconds)
+		if err != nil {
+			return nil, 0, err
+		}
+		if seconds > 0 {
+			return nil, time.Duration(seconds * float64(time.Second)), nil
+		}
+	}
+
+	message, err := insertMessage(ctx, tx, params)
+	if err != nil {
+		return nil, 0, err
+	}
+	return message, 0, tx.Commit()
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func insertMessage(ctx context.Context, q queryRower, params CreateMessageParams) (*models.Message, error) {
+	message := models.Message{
+		SenderID:     params.SenderID,
+		SenderUUID:   params.SenderUUID,
+		ReceiverID:   params.ReceiverID,
+		ReceiverUUID: params.ReceiverUUID,
+		GroupID:      params.GroupID,
+		GroupUUID:    params.GroupUUID,
+		MessageText:  params.MessageText,
+		MediaType:    params.MediaType,
+		MediaURL:     params.MediaURL,
+		Media:        params.Media,
+	}
+	if params.Media != nil {
+		message.MediaID = &params.Media.ID
+	}
+	err := q.QueryRowContext(ctx, `
+			INSERT INTO messages (uuid, sender_id, receiver_id, group_id, message_text, media_type, media_url, media_id)
+			VALUES (uuid_generate_v4(), $1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, ''), $7)
+			RETURNING id, uuid, created_at`,
+		params.SenderID, params.ReceiverID, params.GroupID, params.MessageText, params.MediaType, params.MediaURL, message.MediaID,
+	).Scan(&message.ID, &message.UUID, &message.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// ListMessagesParams selects either a direct conversation (UserID and PeerID)
+// or a group timeline (GroupID). At most one of Before and After is set:
+// Before pages towards older messages, After towards newer ones.
+type ListMessagesParams struct {
+	UserID  int64
+	PeerID  *int64
+	GroupID *int64
+	Before  *MessageCursor
+	After   *MessageCursor
+	Limit   int
+}
+
+// ListMessagesResult holds a page of messages in chronological order. HasMore
+// reports whether further messages exist in the direction that was paged.
+type ListMessagesResult struct {
+	Messages []models.Message
+	HasMore  bool
+}
+
+func EncodeMessageCursor(message *models.Message) string {
+	raw := fmt.Sprintf("%d:%d", message.CreatedAt.UnixNano(), message.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodeMessageCursor(cursor string) (*MessageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidCursor
+	}
+
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &MessageCursor{CreatedAt: time.Unix(0, nanos).UTC(), ID: id}, nil
+}
+
+func ListMessages(ctx context.Context, db *sql.DB, params ListMessagesParams) (*ListMessagesResult, error) {
+	resultChan := make(chan struct {
+		result *ListMessagesResult
+		err    error
+	}, 1)
+
+	go func() {
+		query := selectMessageQuery
+		args := []interface{}{}
+		argCount := 1
+
+		if params.GroupID != nil {
+			query += fmt.Sprintf(" WHERE m.group_id = $%d", argCount)
+			args = append(args, *params.GroupID)
+			argCount++
+		} else {
+			query += fmt.Sprintf(` WHERE m.group_id IS NULL
+				AND ((m.sender_id = $%d AND m.receiver_id = $%d) OR (m.sender_id = $%d AND m.receiver_id = $%d))`,
+				argCount, argCount+1, argCount+1, argCount)
+			args = append(args, params.UserID, *params.PeerID)
+			argCount += 2
+		}
+
+		order := "DESC"
+		if params.Before != nil {
+			query += fmt.Sprintf(" AND (m.created_at, m.id) < ($%d, $%d)", argCount, argCount+1)
+			args = append(args, params.Before.CreatedAt, params.Before.ID)
+			argCount += 2
+		} else if params.After != nil {
+			query += fmt.Sprintf(" AND (m.created_at, m.id) > ($%d, $%d)", argCount, argCount+1)
+			args = append(args, params.After.CreatedAt, params.After.ID)
+			argCount += 2
+			order = "ASC"
+		}
+
+		// Fetch one extra row to find out whether another page exists.
+		query += fmt.Sprintf(" ORDER BY m.created_at %s, m.id %s LIMIT $%d", order, order, argCount)
+		args = append(args, params.Limit+1)
+
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			resultChan <- struct {
+				result *ListMessagesResult
+				err    error
+			}{err: err}
+			return
+		}
+		defer rows.Close()
+
+		messages := []models.Message{}
+		for rows.Next() {
+			message, err := scanMessage(rows)
+			if err != nil {
+				resultChan <- struct {
+					result *ListMessagesResult
+					err    error
+				}{err: err}
+				return
+			}
+			messages = append(messages, *message)
+		}
+
+		result := &ListMessagesResult{Messages: messages}
+		if len(messages) > params.Limit {
+			result.Messages = messages[:params.Limit]
+			result.HasMore = true
+		}
+
+		if order == "DESC" {
+			for i, j := 0, len(result.Messages)-1; i < j; i, j = i+1, j-1 {
+				result.Messages[i], result.Messages[j] = result.Messages[j], result.Messages[i]
+			}
+		}
+
+		resultChan <- struct {
+			result *ListMessagesResult
+			err    error
+		}{result: result, err: rows.Err()}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			log.Printf("Error listing messages: %v", result.err)
+			return nil, fmt.Errorf("could not list messages: %w", result.err)
+		}
+		return result.result, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func GetMessageByUUID(ctx context.Context, db *sql.DB, messageUUID uuid.UUID) (*models.Message, error) {
+	messageChan := make(chan *models.Message, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		message, err := scanMessage(db.QueryRowContext(ctx, selectMessageQuery+" WHERE m.uuid = $1", messageUUID))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				errChan <- ErrMessageNotFound
+			} else {
+				errChan <- fmt.Errorf("error querying message: %v", err)
+			}
+			return
+		}
+
+		messageChan <- message
+	}()
+
+	select {
+	case message := <-messageChan:
+		return message, nil
+	case err := <-errChan:
+		return nil, err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func scanMessage(scanner rowScanner) (*models.Message, error) {
+	var message models.Message
+	var receiverID, groupID sql.NullInt64
+	var receiverUUID, groupUUID uuid.NullUUID
+	var messageText, mediaType, mediaURL sql.NullString
+	var mediaID, mediaOwnerID, mediaSize, mediaWidth, mediaHeight sql.NullInt64
+	var mediaUUID uuid.NullUUID
+	var mediaKey, mediaKind, mediaContentType, mediaThumbnailKey sql.NullString
+	var mediaCreatedAt sql.NullTime
+
+	err := scanner.Scan(&message.ID, &message.UUID, &message.SenderID, &message.SenderUUID, &receiverID, &receiverUUID,
+		&groupID, &groupUUID, &messageText, &mediaType, &mediaURL, &message.CreatedAt,
+		&mediaID, &mediaUUID, &mediaOwnerID, &mediaKey, &mediaKind, &mediaContentType, &mediaSize,
+		&mediaWidth, &mediaHeight, &mediaThumbnailKey, &mediaCreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if mediaID.Valid {
+		message.MediaID = &mediaID.Int64
+		message.Media = &models.Media{
+			ID:           mediaID.Int64,
+			UUID:         mediaUUID.UUID,
+			OwnerID:      mediaOwnerID.Int64,
+			ObjectKey:    mediaKey.String,
+			MediaType:    mediaKind.String,
+			ContentType:  mediaContentType.String,
+			SizeBytes:    mediaSize.Int64,
+			Width:        int(mediaWidth.Int64),
+			Height:       int(mediaHeight.Int64),
+			ThumbnailKey: mediaThumbnailKey.String,
+			CreatedAt:    mediaCreatedAt.Time,
+		}
+	}
+
+	if receiverID.Valid {
+		message.ReceiverID = &receiverID.Int64
+	}
+	if receiverUUID.Valid {
+		message.ReceiverUUID = &receiverUUID.UUID
+	}
+	if groupID.Valid {
+		message.GroupID = &groupID.Int64
+	}
+	if groupUUID.Valid {
+		message.GroupUUID = &groupUUID.UUID
+	}
+	message.MessageText = messageText.String
+	message.MediaType = mediaType.String
+	message.MediaURL = mediaURL.String
+
+	return &message, nil
+}
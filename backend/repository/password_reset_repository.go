@@ -0,0 +1,158 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrPasswordResetTokenInvalid = errors.New("invalid or expired password reset token")
+	ErrPasswordResetThrottled    = errors.New("password reset requested too recently")
+)
+
+type CreatePasswordResetTokenParams struct {
+	UserID    int64
+	TokenHash string
+	ExpiresAt time.Time
+	// A new token is refused while the previous one is younger than this.
+	MinInterval time.Duration
+}
+
+type ResetPasswordParams struct {
+	TokenHash      string
+	HashedPassword string
+}
+
+// ResetPasswordResult identifies the user whose password was reset and the
+// sessions that were revoked with it.
+type ResetPasswordResult struct {
+	UserID          int64
+	RevokedSessions []uuid.UUID
+}
+
+func CreatePasswordResetToken(ctx context.Context, db *sql.DB, params CreatePasswordResetTokenParams) error {
+	errChan := make(chan error, 1)
+
+	go func() {
+		result, err := db.ExecContext(ctx, `
+				INSERT INTO password_reset_tokens (user_id, token_hash, expires_at)
+				SELECT $1, $2, $3
+				WHERE NOT EXISTS (
+					SELECT 1 FROM password_reset_tokens
+					WHERE user_id = $1 AND created_at > CURRENT_TIMESTAMP - $4 * INTERVAL '1 second'
+				)`,
+			params.UserID, params.TokenHash, params.ExpiresAt.UTC(), params.MinInterval.Seconds(),
+		)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err == nil && rowsAffected == 0 {
+			err = ErrPasswordResetThrottled
+		}
+		errChan <- err
+	}()
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			if errors.Is(err, ErrPasswordResetThrottled) {
+				return err
+			}
+			log.Printf("Error inserting password reset token: %v", err)
+			return fmt.Errorf("could not create password reset token: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+// ResetPassword consumes a password reset token and sets the new password of
+// its user. Every other outstanding reset token of the user is voided and all
+// their sessions are revoked, in the same transaction.
+func ResetPassword(ctx context.Context, db *sql.DB, params ResetPasswordParams) (*ResetPasswordResult, error) {
+	resultChan := make(chan struct {
+		result *ResetPasswordResult
+		err    error
+	}, 1)
+
+	go func() {
+		result, err := resetPasswordTx(ctx, db, params)
+		resultChan <- struct {
+			result *ResetPasswordResult
+			err    error
+		}{result: result, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			if errors.Is(result.err, ErrPasswordResetTokenInvalid) {
+				return nil, result.err
+			}
+			log.Printf("Error resetting password: %v", result.err)
+			return nil, fmt.Errorf("could not reset password: %w", result.err)
+		}
+		return result.result, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func resetPasswordTx(ctx context.Context, db *sql.DB, params ResetPasswordParams) (*ResetPasswordResult, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var result ResetPasswordResult
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+	err = tx.QueryRowContext(ctx, `
+			SELECT user_id, expires_at, used_at
+			FROM password_reset_tokens
+			WHERE token_hash = $1
+			FOR UPDATE`,
+		params.TokenHash,
+	).Scan(&result.UserID, &expiresAt, &usedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrPasswordResetTokenInvalid
+		}
+		return nil, err
+	}
+
+	if usedAt.Valid || time.Now().After(expiresAt) {
+		return nil, ErrPasswordResetTokenInvalid
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE password_reset_tokens SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND used_at IS NULL", result.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE users SET password = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $1", result.UserID, params.HashedPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	result.RevokedSessions, err = activeSessionUUIDs(ctx, tx, result.UserID, uuid.Nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := revokeSessions(ctx, tx, result.RevokedSessions); err != nil {
+		return nil, err
+	}
+
+	return &result, tx.Commit()
+}
@@ -0,0 +1,257 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/models"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrPersonalAccessTokenNotFound = errors.New("personal access token not found")
+	ErrPersonalAccessTokenInvalid  = errors.New("invalid, expired or revoked personal access token")
+)
+
+// last_used_at is only refreshed when older than this, so that a busy bot
+// does not write the row on every request.
+const tokenLastUsedResolution = time.Minute
+
+type CreatePersonalAccessTokenParams struct {
+	UserID    int64
+	Name      string
+	TokenHash string
+	Scopes    []string
+	// Nil for a token that does not expire.
+	ExpiresAt *time.Time
+}
+
+const selectPersonalAccessTokenQuery = `
+	SELECT id, uuid, user_id, name, scopes, expires_at, last_used_at, created_at, revoked_at
+	FROM personal_access_tokens`
+
+func scanPersonalAccessToken(scanner rowScanner) (*models.PersonalAccessToken, error) {
+	var token models.PersonalAccessToken
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	err := scanner.Scan(&token.ID, &token.UUID, &token.UserID, &token.Name, pq.Array(&token.Scopes),
+		&expiresAt, &lastUsedAt, &token.CreatedAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		token.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		token.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		token.RevokedAt = &revokedAt.Time
+	}
+	return &token, nil
+}
+
+func CreatePersonalAccessToken(ctx context.Context, db *sql.DB, params CreatePersonalAccessTokenParams) (*models.PersonalAccessToken, error) {
+	resultChan := make(chan struct {
+		token *models.PersonalAccessToken
+		err   error
+	}, 1)
+
+	go func() {
+		token, err := scanPersonalAccessToken(db.QueryRowContext(ctx, `
+				INSERT INTO personal_access_tokens (user_id, name, token_hash, scopes, expires_at, created_at)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				RETURNING id, uuid, user_id, name, scopes, expires_at, last_used_at, created_at, revoked_at`,
+			params.UserID, params.Name, params.TokenHash, pq.Array(params.Scopes), params.ExpiresAt, time.Now().UTC(),
+		))
+		resultChan <- struct {
+			token *models.PersonalAccessToken
+			err   error
+		}{token: token, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			log.Printf("Error inserting personal access token: %v", result.err)
+			return nil, fmt.Errorf("could not create personal access token: %w", result.err)
+		}
+		return result.token, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+// ListPersonalAccessTokens returns the tokens of a user that have not been
+// revoked, newest first. Expired tokens are included so that the user can
+// see and delete them.
+func ListPersonalAccessTokens(ctx context.Context, db *sql.DB, userID int64) ([]models.PersonalAccessToken, error) {
+	resultChan := make(chan struct {
+		tokens []models.PersonalAccessToken
+		err    error
+	}, 1)
+
+	go func() {
+		tokens, err := listPersonalAccessTokens(ctx, db, userID)
+		resultChan <- struct {
+			tokens []models.PersonalAccessToken
+			err    error
+		}{tokens: tokens, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			log.Printf("Error listing personal access tokens: %v", result.err)
+			return nil, fmt.Errorf("could not list personal access tokens: %w", result.err)
+		}
+		return result.tokens, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func listPersonalAccessTokens(ctx context.Context, db *sql.DB, userID int64) ([]models.PersonalAccessToken, error) {
+	rows, err := db.QueryContext(ctx, selectPersonalAccessTokenQuery+`
+			WHERE user_id = $1 AND revoked_at IS NULL
+			ORDER BY created_at DESC, id DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []models.PersonalAccessToken{}
+	for rows.Next() {
+		token, err := scanPersonalAccessToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *token)
+	}
+	return tokens, rows.Err()
+}
+
+func GetPersonalAccessTokenByUUID(ctx context.Context, db *sql.DB, tokenUUID uuid.UUID) (*models.PersonalAccessToken, error) {
+	tokenChan := make(chan *models.PersonalAccessToken, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		token, err := scanPersonalAccessToken(db.QueryRowContext(ctx, selectPersonalAccessTokenQuery+" WHERE uuid = $1", tokenUUID))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				errChan <- ErrPersonalAccessTokenNotFound
+			} else {
+				errChan <- fmt.Errorf("error querying personal access token: %v", err)
+			}
+			return
+		}
+
+		tokenChan <- token
+	}()
+
+	select {
+	case token := <-tokenChan:
+		return token, nil
+	case err := <-errChan:
+		return nil, err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func RevokePersonalAccessToken(ctx context.Context, db *sql.DB, tokenUUID uuid.UUID) error {
+	revoked, err := execAffectsRow(ctx, db, "could not revoke personal access token",
+		"UPDATE personal_access_tokens SET revoked_at = $2 WHERE uuid = $1 AND revoked_at IS NULL",
+		tokenUUID, time.Now().UTC(),
+	)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrPersonalAccessTokenNotFound
+	}
+	return nil
+}
+
+// AuthenticatePersonalAccessToken looks a token up by its hash and returns it
+// along with its owner, or ErrPersonalAccessTokenInvalid when it is unknown,
+// expired or revoked.
+func AuthenticatePersonalAccessToken(ctx context.Context, db *sql.DB, tokenHash string) (*models.PersonalAccessToken, *models.User, error) {
+	resultChan := make(chan struct {
+		token *models.PersonalAccessToken
+		user  *models.User
+		err   error
+	}, 1)
+
+	go func() {
+		token, user, err := authenticatePersonalAccessToken(ctx, db, tokenHash)
+		resultChan <- struct {
+			token *models.PersonalAccessToken
+			user  *models.User
+			err   error
+		}{token: token, user: user, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			if errors.Is(result.err, ErrPersonalAccessTokenInvalid) {
+				return nil, nil, result.err
+			}
+			log.Printf("Error authenticating personal access token: %v", result.err)
+			return nil, nil, fmt.Errorf("could not authenticate personal access token: %w", result.err)
+		}
+		return result.token, result.user, nil
+	case <-ctx.Done():
+		return nil, nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func authenticatePersonalAccessToken(ctx context.Context, db *sql.DB, tokenHash string) (*models.PersonalAccessToken, *models.User, error) {
+	var user models.User
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	token := models.PersonalAccessToken{}
+
+	err := db.QueryRowContext(ctx, `
+			SELECT t.id, t.uuid, t.user_id, t.name, t.scopes, t.expires_at, t.last_used_at, t.created_at, t.revoked_at,
+				u.uuid, u.username, u.email, u.verified
+			FROM personal_access_tokens t
+			JOIN users u ON u.id = t.user_id
+			WHERE t.token_hash = $1`,
+		tokenHash,
+	).Scan(&token.ID, &token.UUID, &token.UserID, &token.Name, pq.Array(&token.Scopes), &expiresAt, &lastUsedAt, &token.CreatedAt, &revokedAt,
+		&user.UUID, &user.Username, &user.Email, &user.Verified)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, ErrPersonalAccessTokenInvalid
+		}
+		return nil, nil, err
+	}
+
+	// Timestamps are written from Go in UTC, so they are compared here too.
+	now := time.Now().UTC()
+	if revokedAt.Valid || (expiresAt.Valid && !expiresAt.Time.After(now)) {
+		return nil, nil, ErrPersonalAccessTokenInvalid
+	}
+	if expiresAt.Valid {
+		token.ExpiresAt = &expiresAt.Time
+	}
+	user.ID = token.UserID
+
+	if !lastUsedAt.Valid || now.Sub(lastUsedAt.Time) > tokenLastUsedResolution {
+		_, err = db.ExecContext(ctx, "UPDATE personal_access_tokens SET last_used_at = $2 WHERE id = $1", token.ID, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		lastUsedAt = sql.NullTime{Time: now, Valid: true}
+	}
+	token.LastUsedAt = &lastUsedAt.Time
+
+	return &token, &user, nil
+}
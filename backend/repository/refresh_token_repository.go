@@ -0,0 +1,141 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("invalid refresh token")
+	ErrRefreshTokenExpired = errors.New("refresh token expired")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+// RotateRefreshTokenParams exchanges the token hashed as OldTokenHash for a
+// new one in the same family. IPAddress is recorded as the session's latest.
+type RotateRefreshTokenParams struct {
+	OldTokenHash string
+	NewTokenHash string
+	ExpiresAt    time.Time
+	IPAddress    string
+}
+
+type RotateRefreshTokenResult struct {
+	UserID   int64
+	FamilyID uuid.UUID
+	// When the user logged in to start the session.
+	AuthenticatedAt time.Time
+}
+
+// RotateRefreshToken marks the presented token as used and issues its
+// successor. Presenting a token that was already rotated or revoked means it
+// leaked, so the whole session is revoked and ErrRefreshTokenReused returned
+// along with the result identifying it.
+func RotateRefreshToken(ctx context.Context, db *sql.DB, params RotateRefreshTokenParams) (*RotateRefreshTokenResult, error) {
+	resultChan := make(chan struct {
+		result *RotateRefreshTokenResult
+		err    error
+	}, 1)
+
+	go func() {
+		result, err := rotateRefreshTokenTx(ctx, db, params)
+		resultChan <- struct {
+			result *RotateRefreshTokenResult
+			err    error
+		}{result: result, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			if errors.Is(result.err, ErrRefreshTokenReused) {
+				return result.result, result.err
+			}
+			if errors.Is(result.err, ErrRefreshTokenInvalid) || errors.Is(result.err, ErrRefreshTokenExpired) {
+				return nil, result.err
+			}
+			log.Printf("Error rotating refresh token: %v", result.err)
+			return nil, fmt.Errorf("could not rotate refresh token: %w", result.err)
+		}
+		return result.result, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func rotateRefreshTokenTx(ctx context.Context, db *sql.DB, params RotateRefreshTokenParams) (*RotateRefreshTokenResult, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var tokenID int64
+	var result RotateRefreshTokenResult
+	var expiresAt time.Time
+	var usedAt, revokedAt sql.NullTime
+	err = tx.QueryRowContext(ctx, `
+			SELECT id, user_id, family_id, expires_at, used_at, revoked_at
+			FROM refresh_tokens
+			WHERE token_hash = $1
+			FOR UPDATE`,
+		params.OldTokenHash,
+	).Scan(&tokenID, &result.UserID, &result.FamilyID, &expiresAt, &usedAt, &revokedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrRefreshTokenInvalid
+		}
+		return nil, err
+	}
+
+	if usedAt.Valid || revokedAt.Valid {
+		if err := revokeSessions(ctx, tx, []uuid.UUID{result.FamilyID}); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return &result, ErrRefreshTokenReused
+	}
+
+	if time.Now().After(expiresAt) {
+		return nil, ErrRefreshTokenExpired
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET used_at = CURRENT_TIMESTAMP WHERE id = $1", tokenID); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+			INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at)
+			VALUES ($1, $2, $3, $4)`,
+		result.UserID, result.FamilyID, params.NewTokenHash, params.ExpiresAt.UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRowContext(ctx, `
+			UPDATE sessions
+			SET last_seen_at = CURRENT_TIMESTAMP, expires_at = $2, ip_address = COALESCE(NULLIF($3, ''), ip_address)
+			WHERE uuid = $1
+			RETURNING created_at`,
+		result.FamilyID, params.ExpiresAt.UTC(), params.IPAddress,
+	).Scan(&result.AuthenticatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, tx.Commit()
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
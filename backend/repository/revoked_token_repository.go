@@ -0,0 +1,103 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// RevokeTokens records the given token or session ids as revoked until
+// expiresAt, after which no token carrying them can be valid anyway. Expired
+// rows are purged on the way.
+func RevokeTokens(ctx context.Context, db *sql.DB, expiresAt time.Time, tokenIDs ...uuid.UUID) error {
+	errChan := make(chan error, 1)
+
+	go func() {
+		_, err := db.ExecContext(ctx, `
+				INSERT INTO revoked_tokens (token_id, expires_at)
+				SELECT UNNEST($1::uuid[]), $2
+				ON CONFLICT (token_id) DO UPDATE SET expires_at = GREATEST(revoked_tokens.expires_at, EXCLUDED.expires_at)`,
+			pq.Array(uuidStrings(tokenIDs)), expiresAt.UTC(),
+		)
+		if err == nil {
+			_, err = db.ExecContext(ctx, "DELETE FROM revoked_tokens WHERE expires_at < CURRENT_TIMESTAMP")
+		}
+		errChan <- err
+	}()
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			log.Printf("Error revoking tokens: %v", err)
+			return fmt.Errorf("could not revoke tokens: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+// GetTokenRevocations returns, for each of the given ids that is currently
+// revoked, the time its revocation expires.
+func GetTokenRevocations(ctx context.Context, db *sql.DB, tokenIDs []uuid.UUID) (map[uuid.UUID]time.Time, error) {
+	resultChan := make(chan struct {
+		revocations map[uuid.UUID]time.Time
+		err         error
+	}, 1)
+
+	go func() {
+		revocations, err := getTokenRevocations(ctx, db, tokenIDs)
+		resultChan <- struct {
+			revocations map[uuid.UUID]time.Time
+			err         error
+		}{revocations: revocations, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			log.Printf("Error querying revoked tokens: %v", result.err)
+			return nil, fmt.Errorf("could not check token revocation: %w", result.err)
+		}
+		return result.revocations, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func getTokenRevocations(ctx context.Context, db *sql.DB, tokenIDs []uuid.UUID) (map[uuid.UUID]time.Time, error) {
+	rows, err := db.QueryContext(ctx, `
+			SELECT token_id, expires_at
+			FROM revoked_tokens
+			WHERE token_id = ANY($1::uuid[]) AND expires_at > CURRENT_TIMESTAMP`,
+		pq.Array(uuidStrings(tokenIDs)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revocations := make(map[uuid.UUID]time.Time)
+	for rows.Next() {
+		var tokenID uuid.UUID
+		var expiresAt time.Time
+		if err := rows.Scan(&tokenID, &expiresAt); err != nil {
+			return nil, err
+		}
+		revocations[tokenID] = expiresAt
+	}
+	return revocations, rows.Err()
+}
+
+func uuidStrings(ids []uuid.UUID) []string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.String()
+	}
+	return strs
+}
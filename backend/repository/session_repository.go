@@ -0,0 +1,301 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/models"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// CreateSessionParams describes a new login session together with its first
+// refresh token.
+type CreateSessionParams struct {
+	UUID             uuid.UUID
+	UserID           int64
+	UserAgent        string
+	IPAddress        string
+	RefreshTokenHash string
+	ExpiresAt        time.Time
+	// When the user authenticated, which is also when the session starts.
+	AuthenticatedAt time.Time
+}
+
+const selectSessionQuery = `
+	SELECT id, uuid, user_id, user_agent, ip_address, expires_at, created_at, last_seen_at, revoked_at
+	FROM sessions`
+
+func scanSession(scanner rowScanner) (*models.Session, error) {
+	var session models.Session
+	var userAgent, ipAddress sql.NullString
+	var revokedAt sql.NullTime
+	err := scanner.Scan(&session.ID, &session.UUID, &session.UserID, &userAgent, &ipAddress, &session.ExpiresAt,
+		&session.CreatedAt, &session.LastSeenAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	session.UserAgent = userAgent.String
+	session.IPAddress = ipAddress.String
+	if revokedAt.Valid {
+		session.RevokedAt = &revokedAt.Time
+	}
+	return &session, nil
+}
+
+// CreateSession records a new session and its first refresh token in one
+// transaction.
+func CreateSession(ctx context.Context, db *sql.DB, params CreateSessionParams) (*models.Session, error) {
+	resultChan := make(chan struct {
+		session *models.Session
+		err     error
+	}, 1)
+
+	go func() {
+		session, err := createSessionTx(ctx, db, params)
+		resultChan <- struct {
+			session *models.Session
+			err     error
+		}{session: session, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			log.Printf("Error creating session: %v", result.err)
+			return nil, fmt.Errorf("could not create session: %w", result.err)
+		}
+		return result.session, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func createSessionTx(ctx context.Context, db *sql.DB, params CreateSessionParams) (*models.Session, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	session, err := scanSession(tx.QueryRowContext(ctx, `
+			INSERT INTO sessions (uuid, user_id, user_agent, ip_address, expires_at, created_at, last_seen_at)
+			VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5, $6, $6)
+			RETURNING id, uuid, user_id, user_agent, ip_address, expires_at, created_at, last_seen_at, revoked_at`,
+		params.UUID, params.UserID, params.UserAgent, params.IPAddress, params.ExpiresAt.UTC(), params.AuthenticatedAt.UTC(),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+			INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at)
+			VALUES ($1, $2, $3, $4)`,
+		params.UserID, params.UUID, params.RefreshTokenHash, params.ExpiresAt.UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, tx.Commit()
+}
+
+func GetSessionByUUID(ctx context.Context, db *sql.DB, sessionUUID uuid.UUID) (*models.Session, error) {
+	sessionChan := make(chan *models.Session, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		session, err := scanSession(db.QueryRowContext(ctx, selectSessionQuery+" WHERE uuid = $1", sessionUUID))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				errChan <- ErrSessionNotFound
+			} else {
+				errChan <- fmt.Errorf("error querying session: %v", err)
+			}
+			return
+		}
+
+		sessionChan <- session
+	}()
+
+	select {
+	case session := <-sessionChan:
+		return session, nil
+	case err := <-errChan:
+		return nil, err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+// ListActiveSessions returns the sessions of a user that are neither revoked
+// nor expired, most recently used first.
+func ListActiveSessions(ctx context.Context, db *sql.DB, userID int64) ([]models.Session, error) {
+	resultChan := make(chan struct {
+		sessions []models.Session
+		err      error
+	}, 1)
+
+	go func() {
+		sessions, err := listActiveSessions(ctx, db, userID)
+		resultChan <- struct {
+			sessions []models.Session
+			err      error
+		}{sessions: sessions, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			log.Printf("Error listing sessions: %v", result.err)
+			return nil, fmt.Errorf("could not list sessions: %w", result.err)
+		}
+		return result.sessions, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func listActiveSessions(ctx context.Context, db *sql.DB, userID int64) ([]models.Session, error) {
+	rows, err := db.QueryContext(ctx, selectSessionQuery+`
+			WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+			ORDER BY last_seen_at DESC, id DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession ends a session and revokes every refresh token issued to it.
+func RevokeSession(ctx context.Context, db *sql.DB, sessionUUID uuid.UUID) error {
+	errChan := make(chan error, 1)
+
+	go func() {
+		errChan <- revokeSessionTx(ctx, db, sessionUUID)
+	}()
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			log.Printf("Error revoking session: %v", err)
+			return fmt.Errorf("could not revoke session: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+// RevokeOtherSessions ends every active session of a user except keep, which
+// may be uuid.Nil to end them all, and returns the UUIDs of those revoked.
+func RevokeOtherSessions(ctx context.Context, db *sql.DB, userID int64, keep uuid.UUID) ([]uuid.UUID, error) {
+	resultChan := make(chan struct {
+		sessionUUIDs []uuid.UUID
+		err          error
+	}, 1)
+
+	go func() {
+		sessionUUIDs, err := revokeOtherSessionsTx(ctx, db, userID, keep)
+		resultChan <- struct {
+			sessionUUIDs []uuid.UUID
+			err          error
+		}{sessionUUIDs: sessionUUIDs, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			log.Printf("Error revoking sessions: %v", result.err)
+			return nil, fmt.Errorf("could not revoke sessions: %w", result.err)
+		}
+		return result.sessionUUIDs, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func revokeOtherSessionsTx(ctx context.Context, db *sql.DB, userID int64, keep uuid.UUID) ([]uuid.UUID, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	sessionUUIDs, err := activeSessionUUIDs(ctx, tx, userID, keep)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := revokeSessions(ctx, tx, sessionUUIDs); err != nil {
+		return nil, err
+	}
+
+	return sessionUUIDs, tx.Commit()
+}
+
+// activeSessionUUIDs lists the active sessions of a user other than keep.
+func activeSessionUUIDs(ctx context.Context, tx *sql.Tx, userID int64, keep uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := tx.QueryContext(ctx, `
+			SELECT uuid FROM sessions
+			WHERE user_id = $1 AND uuid <> $2 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP`,
+		userID, keep,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessionUUIDs := []uuid.UUID{}
+	for rows.Next() {
+		var sessionUUID uuid.UUID
+		if err := rows.Scan(&sessionUUID); err != nil {
+			return nil, err
+		}
+		sessionUUIDs = append(sessionUUIDs, sessionUUID)
+	}
+	return sessionUUIDs, rows.Err()
+}
+
+func revokeSessionTx(ctx context.Context, db *sql.DB, sessionUUID uuid.UUID) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := revokeSessions(ctx, tx, []uuid.UUID{sessionUUID}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func revokeSessions(ctx context.Context, execer execer, sessionUUIDs []uuid.UUID) error {
+	if len(sessionUUIDs) == 0 {
+		return nil
+	}
+
+	ids := pq.Array(uuidStrings(sessionUUIDs))
+	if _, err := execer.ExecContext(ctx, "UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE uuid = ANY($1::uuid[]) AND revoked_at IS NULL", ids); err != nil {
+		return err
+	}
+	_, err := execer.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE family_id = ANY($1::uuid[]) AND revoked_at IS NULL", ids)
+	return err
+}
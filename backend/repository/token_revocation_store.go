@@ -0,0 +1,120 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// How long an id that was found not to be revoked is trusted before
+// Postgres is asked again. Revocations made on this instance take effect
+// immediately; the TTL bounds the delay for those made by other instances.
+const revocationNegativeTTL = 10 * time.Second
+
+// TokenRevocationStore answers whether an access token has been revoked,
+// caching lookups in memory so that authenticating a request does not hit
+// Postgres every time. Revoked ids are cached until their revocation expires.
+type TokenRevocationStore struct {
+	mu        sync.RWMutex
+	entries   map[uuid.UUID]revocationEntry
+	lastSweep time.Time
+}
+
+type revocationEntry struct {
+	revoked bool
+	until   time.Time
+}
+
+var tokenRevocationStore = NewTokenRevocationStore()
+
+func NewTokenRevocationStore() *TokenRevocationStore {
+	return &TokenRevocationStore{
+		entries:   make(map[uuid.UUID]revocationEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+func GetTokenRevocationStore() *TokenRevocationStore {
+	return tokenRevocationStore
+}
+
+// IsRevoked reports whether any of the given ids, typically a token's jti and
+// its session id, has been revoked. Nil ids are ignored.
+func (s *TokenRevocationStore) IsRevoked(ctx context.Context, db *sql.DB, tokenIDs ...uuid.UUID) (bool, error) {
+	now := time.Now()
+	var missing []uuid.UUID
+
+	s.mu.RLock()
+	for _, tokenID := range tokenIDs {
+		if tokenID == uuid.Nil {
+			continue
+		}
+		entry, ok := s.entries[tokenID]
+		if !ok || now.After(entry.until) {
+			missing = append(missing, tokenID)
+			continue
+		}
+		if entry.revoked {
+			s.mu.RUnlock()
+			return true, nil
+		}
+	}
+	s.mu.RUnlock()
+
+	if len(missing) == 0 {
+		return false, nil
+	}
+
+	revocations, err := GetTokenRevocations(ctx, db, missing)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+	revoked := false
+	for _, tokenID := range missing {
+		if expiresAt, ok := revocations[tokenID]; ok {
+			s.entries[tokenID] = revocationEntry{revoked: true, until: expiresAt}
+			revoked = true
+		} else {
+			s.entries[tokenID] = revocationEntry{until: now.Add(revocationNegativeTTL)}
+		}
+	}
+	return revoked, nil
+}
+
+// Revoke persists the revocation of the given ids until expiresAt and makes
+// it visible to this instance immediately.
+func (s *TokenRevocationStore) Revoke(ctx context.Context, db *sql.DB, expiresAt time.Time, tokenIDs ...uuid.UUID) error {
+	if err := RevokeTokens(ctx, db, expiresAt, tokenIDs...); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, tokenID := range tokenIDs {
+		s.entries[tokenID] = revocationEntry{revoked: true, until: expiresAt}
+	}
+	return nil
+}
+
+// sweep drops expired entries at most once per minute so the map does not
+// grow with every token ever seen. The caller must hold the write lock.
+func (s *TokenRevocationStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	for tokenID, entry := range s.entries {
+		if now.After(entry.until) {
+			delete(s.entries, tokenID)
+		}
+	}
+	s.lastSweep = now
+}
@@ -0,0 +1,256 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+)
+
+var (
+	ErrTOTPAlreadyEnabled = errors.New("two-factor authentication already enabled")
+	ErrTOTPNotEnrolled    = errors.New("two-factor authentication not enrolled")
+)
+
+// TOTPState is the two-factor configuration of a user. Secret is set from
+// enrollment on, but only checked at login once Enabled.
+type TOTPState struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+func GetTOTPState(ctx context.Context, db *sql.DB, userID int64) (*TOTPState, error) {
+	stateChan := make(chan *TOTPState, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		var state TOTPState
+		var secret sql.NullString
+		var lastStep sql.NullInt64
+		err := db.QueryRowContext(ctx, "SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = $1", userID).
+			Scan(&secret, &state.Enabled, &lastStep)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				errChan <- ErrUserNotFound
+			} else {
+				errChan <- fmt.Errorf("error querying user: %v", err)
+			}
+			return
+		}
+
+		state.Secret = secret.String
+		state.LastStep = lastStep.Int64
+		stateChan <- &state
+	}()
+
+	select {
+	case state := <-stateChan:
+		return state, nil
+	case err := <-errChan:
+		return nil, err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+// SetPendingTOTPSecret starts, or restarts, enrollment with a new secret. It
+// fails with ErrTOTPAlreadyEnabled once enrollment has been confirmed.
+func SetPendingTOTPSecret(ctx context.Context, db *sql.DB, userID int64, secret string) error {
+	errChan := make(chan error, 1)
+
+	go func() {
+		result, err := db.ExecContext(ctx, `
+				UPDATE users SET totp_secret = $2, totp_last_step = NULL
+				WHERE id = $1 AND totp_enabled = FALSE`,
+			userID, secret,
+		)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err == nil && rowsAffected == 0 {
+			err = ErrTOTPAlreadyEnabled
+		}
+		errChan <- err
+	}()
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			if errors.Is(err, ErrTOTPAlreadyEnabled) {
+				return err
+			}
+			log.Printf("Error storing TOTP secret: %v", err)
+			return fmt.Errorf("could not store TOTP secret: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+// EnableTOTP confirms enrollment, recording step as the last code used, and
+// replaces the user's recovery codes with the given hashes.
+func EnableTOTP(ctx context.Context, db *sql.DB, userID int64, step int64, recoveryCodeHashes []string) error {
+	errChan := make(chan error, 1)
+
+	go func() {
+		errChan <- enableTOTPTx(ctx, db, userID, step, recoveryCodeHashes)
+	}()
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			if errors.Is(err, ErrTOTPAlreadyEnabled) || errors.Is(err, ErrTOTPNotEnrolled) {
+				return err
+			}
+			log.Printf("Error enabling TOTP: %v", err)
+			return fmt.Errorf("could not enable two-factor authentication: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func enableTOTPTx(ctx context.Context, db *sql.DB, userID int64, step int64, recoveryCodeHashes []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var enabled bool
+	var secret sql.NullString
+	err = tx.QueryRowContext(ctx, "SELECT totp_enabled, totp_secret FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&enabled, &secret)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUserNotFound
+		}
+		return err
+	}
+	if enabled {
+		return ErrTOTPAlreadyEnabled
+	}
+	if !secret.Valid {
+		return ErrTOTPNotEnrolled
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET totp_enabled = TRUE, totp_last_step = $2 WHERE id = $1", userID, step); err != nil {
+		return err
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DisableTOTP turns two-factor authentication off and discards the secret and
+// the recovery codes.
+func DisableTOTP(ctx context.Context, db *sql.DB, userID int64) error {
+	errChan := make(chan error, 1)
+
+	go func() {
+		errChan <- disableTOTPTx(ctx, db, userID)
+	}()
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			log.Printf("Error disabling TOTP: %v", err)
+			return fmt.Errorf("could not disable two-factor authentication: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func disableTOTPTx(ctx context.Context, db *sql.DB, userID int64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "UPDATE users SET totp_enabled = FALSE, totp_secret = NULL, totp_last_step = NULL WHERE id = $1", userID)
+	if err != nil {
+		return err
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, nil); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records that the code of the given time step was used, and
+// reports false when that step or a later one already was, which means the
+// code is being replayed.
+func UseTOTPStep(ctx context.Context, db *sql.DB, userID int64, step int64) (bool, error) {
+	return execAffectsRow(ctx, db, "could not record TOTP code", `
+			UPDATE users SET totp_last_step = $2
+			WHERE id = $1 AND totp_enabled = TRUE AND (totp_last_step IS NULL OR totp_last_step < $2)`,
+		userID, step,
+	)
+}
+
+// UseRecoveryCode consumes the unused recovery code with the given hash and
+// reports whether there was one.
+func UseRecoveryCode(ctx context.Context, db *sql.DB, userID int64, codeHash string) (bool, error) {
+	return execAffectsRow(ctx, db, "could not use recovery code", `
+			UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP
+			WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+		userID, codeHash,
+	)
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int64, codeHashes []string) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	for _, codeHash := range codeHashes {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)", userID, codeHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execAffectsRow runs a conditional update and reports whether it matched a
+// row.
+func execAffectsRow(ctx context.Context, db *sql.DB, errMessage string, query string, args ...interface{}) (bool, error) {
+	resultChan := make(chan struct {
+		affected bool
+		err      error
+	}, 1)
+
+	go func() {
+		result, err := db.ExecContext(ctx, query, args...)
+		var rowsAffected int64
+		if err == nil {
+			rowsAffected, err = result.RowsAffected()
+		}
+		resultChan <- struct {
+			affected bool
+			err      error
+		}{affected: rowsAffected > 0, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			log.Printf("Error: %s: %v", errMessage, result.err)
+			return false, fmt.Errorf("%s: %w", errMessage, result.err)
+		}
+		return result.affected, nil
+	case <-ctx.Done():
+		return false, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,139 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/AndreaCasaluci/go-chat-app/models"
+)
+
+var ErrBlockNotFound = errors.New("user is not blocked")
+
+// BlockUser records that blocker blocked blocked. Blocking twice is a no-op.
+func BlockUser(ctx context.Context, db *sql.DB, blockerID, blockedID int64) error {
+	errChan := make(chan error, 1)
+
+	go func() {
+		_, err := db.ExecContext(ctx, `
+				INSERT INTO user_blocks (blocker_id, blocked_id)
+				VALUES ($1, $2)
+				ON CONFLICT (blocker_id, blocked_id) DO NOTHING`,
+			blockerID, blockedID,
+		)
+		errChan <- err
+	}()
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			log.Printf("Error inserting user block: %v", err)
+			return fmt.Errorf("could not block user: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func UnblockUser(ctx context.Context, db *sql.DB, blockerID, blockedID int64) error {
+	unblocked, err := execAffectsRow(ctx, db, "could not unblock user",
+		"DELETE FROM user_blocks WHERE blocker_id = $1 AND blocked_id = $2",
+		blockerID, blockedID,
+	)
+	if err != nil {
+		return err
+	}
+	if !unblocked {
+		return ErrBlockNotFound
+	}
+	return nil
+}
+
+// ListBlockedUsers returns the users blocked by blocker, most recent first.
+func ListBlockedUsers(ctx context.Context, db *sql.DB, blockerID int64) ([]models.User, error) {
+	resultChan := make(chan struct {
+		users []models.User
+		err   error
+	}, 1)
+
+	go func() {
+		users, err := listBlockedUsers(ctx, db, blockerID)
+		resultChan <- struct {
+			users []models.User
+			err   error
+		}{users: users, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			log.Printf("Error listing blocked users: %v", result.err)
+			return nil, fmt.Errorf("could not list blocked users: %w", result.err)
+		}
+		return result.users, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func listBlockedUsers(ctx context.Context, db *sql.DB, blockerID int64) ([]models.User, error) {
+	rows, err := db.QueryContext(ctx, `
+			SELECT u.id, u.uuid, u.username, u.created_at
+			FROM user_blocks b
+			JOIN users u ON u.id = b.blocked_id
+			WHERE b.blocker_id = $1
+			ORDER BY b.created_at DESC, u.id`,
+		blockerID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	for rows.Next() {
+		var user models.User
+		if err := rows.Scan(&user.ID, &user.UUID, &user.Username, &user.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// IsBlockedBetween reports whether either user blocked the other.
+func IsBlockedBetween(ctx context.Context, db *sql.DB, userID, otherID int64) (bool, error) {
+	resultChan := make(chan struct {
+		blocked bool
+		err     error
+	}, 1)
+
+	go func() {
+		var blocked bool
+		err := db.QueryRowContext(ctx, `
+				SELECT EXISTS (
+					SELECT 1 FROM user_blocks
+					WHERE (blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1)
+				)`,
+			userID, otherID,
+		).Scan(&blocked)
+		resultChan <- struct {
+			blocked bool
+			err     error
+		}{blocked: blocked, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			log.Printf("Error checking user blocks: %v", result.err)
+			return false, fmt.Errorf("could not check user blocks: %w", result.err)
+		}
+		return result.blocked, nil
+	case <-ctx.Done():
+		return false, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
@@ -3,15 +3,23 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/AndreaCasaluci/go-chat-app/models"
 	"github.com/AndreaCasaluci/go-chat-app/utils"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 	"log"
 	"time"
 )
 
+var (
+	ErrUserNotFound       = errors.New("user not found")
+	ErrInvalidPassword    = errors.New("invalid password")
+	ErrInvalidCredentials = errors.New("invalid email or password")
+)
+
 type UserExistsResult struct {
 	Exists bool
 	Field  string
@@ -111,12 +119,12 @@ func AuthenticateUser(ctx context.Context, db *sql.DB, email, password string) (
 
 	go func() {
 		var user models.User
-		err := db.QueryRowContext(ctx, "SELECT id, uuid, username, email, password FROM users WHERE LOWER(email) = LOWER($1)", email).
-			Scan(&user.ID, &user.UUID, &user.Username, &user.Email, &user.Password)
+		err := db.QueryRowContext(ctx, "SELECT id, uuid, username, email, password, totp_enabled FROM users WHERE LOWER(email) = LOWER($1)", email).
+			Scan(&user.ID, &user.UUID, &user.Username, &user.Email, &user.Password, &user.TOTPEnabled)
 
 		if err != nil {
 			if err == sql.ErrNoRows {
-				errChan <- fmt.Errorf("invalid email or password")
+				errChan <- ErrInvalidCredentials
 			} else {
 				errChan <- fmt.Errorf("error querying user: %v", err)
 			}
@@ -124,7 +132,7 @@ func AuthenticateUser(ctx context.Context, db *sql.DB, email, password string) (
 		}
 
 		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
-			errChan <- fmt.Errorf("invalid email or password")
+			errChan <- ErrInvalidCredentials
 			return
 		}
 
@@ -142,6 +150,38 @@ func AuthenticateUser(ctx context.Context, db *sql.DB, email, password string) (
 	}
 }
 
+// VerifyUserPassword checks password against the stored hash of the user,
+// returning ErrInvalidPassword when it does not match.
+func VerifyUserPassword(ctx context.Context, db *sql.DB, userID int64, password string) error {
+	errChan := make(chan error, 1)
+
+	go func() {
+		var hashedPassword string
+		err := db.QueryRowContext(ctx, "SELECT password FROM users WHERE id = $1", userID).Scan(&hashedPassword)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				errChan <- ErrUserNotFound
+			} else {
+				errChan <- fmt.Errorf("error querying user: %v", err)
+			}
+			return
+		}
+
+		if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)); err != nil {
+			errChan <- ErrInvalidPassword
+			return
+		}
+		errChan <- nil
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
 func UpdateUser(ctx context.Context, db *sql.DB, params UpdateUserParams) (*models.User, error) {
 	userChan := make(chan *models.User)
 	errChan := make(chan error)
@@ -162,7 +202,8 @@ func UpdateUser(ctx context.Context, db *sql.DB, params UpdateUserParams) (*mode
 		}
 
 		if params.Email != nil {
-			query += fmt.Sprintf(", email=$%d", argCount)
+			// A new address has to be verified again.
+			query += fmt.Sprintf(", email=$%d, verified=(verified AND email=$%d), verification_sent_at=CASE WHEN email=$%d THEN verification_sent_at END", argCount, argCount, argCount)
 			args = append(args, *params.Email)
 			argCount++
 		}
@@ -178,9 +219,9 @@ func UpdateUser(ctx context.Context, db *sql.DB, params UpdateUserParams) (*mode
 			argCount++
 		}
 
-		query += fmt.Sprintf(" WHERE uuid=$%d RETURNING id, username, email, uuid, created_at, updated_at", argCount)
+		query += fmt.Sprintf(" WHERE uuid=$%d RETURNING id, username, email, uuid, verified, created_at, updated_at", argCount)
 		args = append(args, params.UserUUID)
-		err := db.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.Username, &user.Email, &user.UUID, &user.CreatedAt, &user.UpdatedAt)
+		err := db.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.Username, &user.Email, &user.UUID, &user.Verified, &user.CreatedAt, &user.UpdatedAt)
 		if err != nil {
 			errChan <- fmt.Errorf("could not update user: %v", err)
 			return
@@ -199,3 +240,147 @@ func UpdateUser(ctx context.Context, db *sql.DB, params UpdateUserParams) (*mode
 		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
 	}
 }
+
+func GetUserByUUID(ctx context.Context, db *sql.DB, userUUID uuid.UUID) (*models.User, error) {
+	userChan := make(chan *models.User, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		var user models.User
+		err := db.QueryRowContext(ctx, "SELECT id, uuid, username, email, verified, created_at, updated_at FROM users WHERE uuid = $1", userUUID).
+			Scan(&user.ID, &user.UUID, &user.Username, &user.Email, &user.Verified, &user.CreatedAt, &user.UpdatedAt)
+
+		if err != nil {
+			if err == sql.ErrNoRows {
+				errChan <- ErrUserNotFound
+			} else {
+				errChan <- fmt.Errorf("error querying user: %v", err)
+			}
+			return
+		}
+
+		userChan <- &user
+	}()
+
+	select {
+	case user := <-userChan:
+		return user, nil
+	case err := <-errChan:
+		return nil, err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func GetUserByID(ctx context.Context, db *sql.DB, userID int64) (*models.User, error) {
+	userChan := make(chan *models.User, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		var user models.User
+		err := db.QueryRowContext(ctx, "SELECT id, uuid, username, email, verified, created_at, updated_at FROM users WHERE id = $1", userID).
+			Scan(&user.ID, &user.UUID, &user.Username, &user.Email, &user.Verified, &user.CreatedAt, &user.UpdatedAt)
+
+		if err != nil {
+			if err == sql.ErrNoRows {
+				errChan <- ErrUserNotFound
+			} else {
+				errChan <- fmt.Errorf("error querying user: %v", err)
+			}
+			return
+		}
+
+		userChan <- &user
+	}()
+
+	select {
+	case user := <-userChan:
+		return user, nil
+	case err := <-errChan:
+		return nil, err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+// GetUserByEmail looks a user up by email address, ignoring case.
+func GetUserByEmail(ctx context.Context, db *sql.DB, email string) (*models.User, error) {
+	userChan := make(chan *models.User, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		var user models.User
+		err := db.QueryRowContext(ctx, "SELECT id, uuid, username, email, verified, created_at, updated_at FROM users WHERE LOWER(email) = LOWER($1)", email).
+			Scan(&user.ID, &user.UUID, &user.Username, &user.Email, &user.Verified, &user.CreatedAt, &user.UpdatedAt)
+
+		if err != nil {
+			if err == sql.ErrNoRows {
+				errChan <- ErrUserNotFound
+			} else {
+				errChan <- fmt.Errorf("error querying user: %v", err)
+			}
+			return
+		}
+
+		userChan <- &user
+	}()
+
+	select {
+	case user := <-userChan:
+		return user, nil
+	case err := <-errChan:
+		return nil, err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+// GetUsersByUUIDs loads every existing user among the given UUIDs; unknown
+// UUIDs are silently skipped.
+func GetUsersByUUIDs(ctx context.Context, db *sql.DB, userUUIDs []uuid.UUID) ([]models.User, error) {
+	resultChan := make(chan struct {
+		users []models.User
+		err   error
+	}, 1)
+
+	go func() {
+		users := []models.User{}
+
+		rows, err := db.QueryContext(ctx, "SELECT id, uuid, username, email, verified, created_at, updated_at FROM users WHERE uuid = ANY($1::uuid[])", pq.Array(uuidStrings(userUUIDs)))
+		if err != nil {
+			resultChan <- struct {
+				users []models.User
+				err   error
+			}{err: err}
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var user models.User
+			if err := rows.Scan(&user.ID, &user.UUID, &user.Username, &user.Email, &user.Verified, &user.CreatedAt, &user.UpdatedAt); err != nil {
+				resultChan <- struct {
+					users []models.User
+					err   error
+				}{err: err}
+				return
+			}
+			users = append(users, user)
+		}
+
+		resultChan <- struct {
+			users []models.User
+			err   error
+		}{users: users, err: rows.Err()}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			return nil, fmt.Errorf("error querying users: %w", result.err)
+		}
+		return result.users, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
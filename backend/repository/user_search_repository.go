@@ -0,0 +1,121 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/AndreaCasaluci/go-chat-app/models"
+)
+
+// SearchUsersParams searches usernames for Query on behalf of SearcherID, who
+// is left out of the results along with the users blocked either way.
+type SearchUsersParams struct {
+	SearcherID int64
+	Query      string
+	Offset     int
+	Limit      int
+}
+
+// SearchUsersResult holds a page of matches, best first. HasMore reports
+// whether another page follows.
+type SearchUsersResult struct {
+	Users   []models.User
+	HasMore bool
+}
+
+// EncodeSearchCursor encodes the offset of the next search page. Search pages
+// are addressed by offset, since results are ranked by a score rather than
+// by a unique column; the cursor keeps that an implementation detail.
+func EncodeSearchCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+func DecodeSearchCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	offset, err := strconv.Atoi(string(raw))
+	if err != nil || offset < 0 {
+		return 0, ErrInvalidCursor
+	}
+	return offset, nil
+}
+
+// SearchUsers matches usernames starting with the query first, then those
+// similar to it by trigrams, most similar first. Both kinds of match are
+// served by the trigram index on users.username.
+func SearchUsers(ctx context.Context, db *sql.DB, params SearchUsersParams) (*SearchUsersResult, error) {
+	resultChan := make(chan struct {
+		result *SearchUsersResult
+		err    error
+	}, 1)
+
+	go func() {
+		result, err := searchUsers(ctx, db, params)
+		resultChan <- struct {
+			result *SearchUsersResult
+			err    error
+		}{result: result, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			log.Printf("Error searching users: %v", result.err)
+			return nil, fmt.Errorf("could not search users: %w", result.err)
+		}
+		return result.result, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation canceled: %w", ctx.Err())
+	}
+}
+
+func searchUsers(ctx context.Context, db *sql.DB, params SearchUsersParams) (*SearchUsersResult, error) {
+	rows, err := db.QueryContext(ctx, `
+			SELECT u.id, u.uuid, u.username, u.created_at
+			FROM users u
+			WHERE (u.username ILIKE $2 OR u.username % $1)
+				AND u.id <> $3
+				AND NOT EXISTS (
+					SELECT 1 FROM user_blocks b
+					WHERE (b.blocker_id = $3 AND b.blocked_id = u.id) OR (b.blocker_id = u.id AND b.blocked_id = $3)
+				)
+			ORDER BY u.username ILIKE $2 DESC, similarity(u.username, $1) DESC, u.username, u.id
+			LIMIT $4 OFFSET $5`,
+		params.Query, escapeLike(params.Query)+"%", params.SearcherID, params.Limit+1, params.Offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	for rows.Next() {
+		var user models.User
+		if err := rows.Scan(&user.ID, &user.UUID, &user.Username, &user.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &SearchUsersResult{Users: users}
+	if len(users) > params.Limit {
+		result.Users = users[:params.Limit]
+		result.HasMore = true
+	}
+	return result, nil
+}
+
+// escapeLike escapes the LIKE wildcards in s, so that it matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
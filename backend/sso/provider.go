@@ -0,0 +1,171 @@
+package sso
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/utils"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// ErrNotConfigured is returned by GetProvider when no OIDC issuer is set.
+var ErrNotConfigured = errors.New("OIDC login is not configured")
+
+// Time allowed to fetch the discovery document of the issuer.
+const discoveryTimeout = 10 * time.Second
+
+var defaultScopes = []string{oidc.ScopeOpenID, "email", "profile"}
+
+type ProviderOptions struct {
+	// Name identifies the provider in user_identities, e.g. "google".
+	Name         string
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Provider signs users in with an external OpenID Connect issuer using the
+// authorization code flow with PKCE.
+type Provider struct {
+	Name     string
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// Identity is what the issuer asserted about the user in the ID token.
+type Identity struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+}
+
+// NewProvider fetches the discovery document of the issuer and builds a
+// provider from it.
+func NewProvider(ctx context.Context, options ProviderOptions) (*Provider, error) {
+	provider, err := oidc.NewProvider(ctx, options.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not discover OIDC issuer %s: %w", options.IssuerURL, err)
+	}
+
+	scopes := options.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultScopes
+	}
+
+	return &Provider{
+		Name: options.Name,
+		oauth2: oauth2.Config{
+			ClientID:     options.ClientID,
+			ClientSecret: options.ClientSecret,
+			RedirectURL:  options.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       scopes,
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: options.ClientID}),
+	}, nil
+}
+
+// AuthCodeURL returns the URL of the issuer's consent page. state and nonce
+// tie the callback and the ID token to this attempt; verifier is the PKCE
+// code verifier, of which only the challenge is sent.
+func (p *Provider) AuthCodeURL(state, nonce, verifier string) string {
+	return p.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+}
+
+// Exchange redeems the authorization code and returns the identity in the
+// verified ID token, which must carry the nonce of the attempt.
+func (p *Provider) Exchange(ctx context.Context, code, nonce, verifier string) (*Identity, error) {
+	token, err := p.oauth2.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("could not exchange authorization code: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+
+	var claims struct {
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+		Name              string `json:"name"`
+		PreferredUsername string `json:"preferred_username"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("could not decode ID token claims: %w", err)
+	}
+
+	return &Identity{
+		Subject:           idToken.Subject,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		Name:              claims.Name,
+		PreferredUsername: claims.PreferredUsername,
+	}, nil
+}
+
+var provider *Provider = nil
+
+func newProvider() (*Provider, error) {
+	config, err := utils.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.OIDCIssuerURL == "" {
+		return nil, ErrNotConfigured
+	}
+
+	name := config.OIDCProviderName
+	if name == "" {
+		name = "oidc"
+	}
+
+	redirectURL := config.OIDCRedirectURL
+	if redirectURL == "" {
+		redirectURL = strings.TrimRight(config.AppBaseURL, "/") + "/auth/oidc/callback"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+	defer cancel()
+
+	return NewProvider(ctx, ProviderOptions{
+		Name:         name,
+		IssuerURL:    config.OIDCIssuerURL,
+		ClientID:     config.OIDCClientID,
+		ClientSecret: config.OIDCClientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       strings.Fields(config.OIDCScopes),
+	})
+}
+
+// GetProvider returns the provider configured by the OIDC_* settings. A
+// failed discovery is not cached, so that it is retried on the next login.
+func GetProvider() (*Provider, error) {
+	if provider != nil {
+		return provider, nil
+	}
+
+	p, err := newProvider()
+	if err != nil {
+		return nil, err
+	}
+	provider = p
+	return provider, nil
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LocalStorage keeps objects on the local filesystem. It stands in for MinIO
+// in local development and tests; each object has a JSON sidecar holding its
+// content type.
+type LocalStorage struct {
+	root string
+}
+
+type localObjectMeta struct {
+	ContentType string `json:"content_type"`
+}
+
+func NewLocalStorage(root string) (*LocalStorage, error) {
+	if root == "" {
+		return nil, fmt.Errorf("missing local storage directory")
+	}
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		return nil, fmt.Errorf("could not create storage directory: %w", err)
+	}
+	return &LocalStorage{root: root}, nil
+}
+
+func (s *LocalStorage) Put(ctx context.Context, key string, reader io.Reader, size int64, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return fmt.Errorf("could not create object directory: %w", err)
+	}
+
+	// Write to a temporary file first so readers never observe partial objects.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("could not create object: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, reader); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write object: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not write object: %w", err)
+	}
+
+	meta, err := json.Marshal(localObjectMeta{ContentType: contentType})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".meta", meta, 0o640); err != nil {
+		return fmt.Errorf("could not write object metadata: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("could not store object: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalStorage) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, ErrObjectNotFound
+		}
+		return nil, nil, fmt.Errorf("could not open object: %w", err)
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("could not stat object: %w", err)
+	}
+
+	info := &ObjectInfo{Key: key, Size: stat.Size(), LastModified: stat.ModTime()}
+	if raw, err := os.ReadFile(path + ".meta"); err == nil {
+		var meta localObjectMeta
+		if json.Unmarshal(raw, &meta) == nil {
+			info.ContentType = meta.ContentType
+		}
+	}
+
+	return file, info, nil
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("could not delete object: %w", err)
+	}
+	if err := os.Remove(path + ".meta"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("could not delete object metadata: %w", err)
+	}
+	return nil
+}
+
+// PresignGet is not supported: the local backend has nothing that could
+// serve a signed URL, so objects are streamed through the API instead.
+func (s *LocalStorage) PresignGet(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return "", ErrPresignNotSupported
+}
+
+// path maps an object key to a file below the storage root, rejecting keys
+// that would escape it.
+func (s *LocalStorage) path(key string) (string, error) {
+	cleaned := filepath.Clean("/" + key)
+	if key == "" || strings.HasSuffix(cleaned, ".meta") {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(cleaned)), nil
+}
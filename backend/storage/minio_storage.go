@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const defaultMinioRegion = "us-east-1"
+
+// MinioStorage stores objects in a MinIO (or any S3 compatible) bucket.
+type MinioStorage struct {
+	client        *minio.Client
+	presignClient *minio.Client
+	bucket        string
+}
+
+type MinioOptions struct {
+	Endpoint string
+	// PublicEndpoint is the host clients use to reach MinIO. Presigned URLs
+	// are signed for it, since the signature covers the host. Defaults to Endpoint.
+	PublicEndpoint string
+	Region         string
+	AccessKey      string
+	SecretKey      string
+	Bucket         string
+	UseSSL         bool
+}
+
+func NewMinioStorage(options MinioOptions) (*MinioStorage, error) {
+	if options.Endpoint == "" || options.AccessKey == "" || options.SecretKey == "" || options.Bucket == "" {
+		return nil, fmt.Errorf("missing MinIO configuration")
+	}
+	if options.Region == "" {
+		options.Region = defaultMinioRegion
+	}
+
+	client, err := newMinioClient(options, options.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	presignClient := client
+	if options.PublicEndpoint != "" && options.PublicEndpoint != options.Endpoint {
+		presignClient, err = newMinioClient(options, options.PublicEndpoint)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, options.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("could not check bucket %s: %w", options.Bucket, err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, options.Bucket, minio.MakeBucketOptions{Region: options.Region}); err != nil {
+			return nil, fmt.Errorf("could not create bucket %s: %w", options.Bucket, err)
+		}
+	}
+
+	return &MinioStorage{client: client, presignClient: presignClient, bucket: options.Bucket}, nil
+}
+
+func newMinioClient(options MinioOptions, endpoint string) (*minio.Client, error) {
+	// A fixed region keeps presigning offline instead of looking up the bucket location.
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(options.AccessKey, options.SecretKey, ""),
+		Secure: options.UseSSL,
+		Region: options.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create MinIO client: %w", err)
+	}
+	return client, nil
+}
+
+func (s *MinioStorage) Put(ctx context.Context, key string, reader io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, reader, size, minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return fmt.Errorf("could not upload object: %w", err)
+	}
+	return nil
+}
+
+func (s *MinioStorage) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not get object: %w", err)
+	}
+
+	stat, err := object.Stat()
+	if err != nil {
+		object.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, nil, ErrObjectNotFound
+		}
+		return nil, nil, fmt.Errorf("could not stat object: %w", err)
+	}
+
+	return object, &ObjectInfo{
+		Key:          key,
+		Size:         stat.Size,
+		ContentType:  stat.ContentType,
+		LastModified: stat.LastModified,
+	}, nil
+}
+
+func (s *MinioStorage) Delete(ctx context.Context, key string) error {
+	if err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("could not delete object: %w", err)
+	}
+	return nil
+}
+
+func (s *MinioStorage) PresignGet(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	presignedURL, err := s.presignClient.PresignedGetObject(ctx, s.bucket, key, expiry, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not presign object: %w", err)
+	}
+	return presignedURL.String(), nil
+}
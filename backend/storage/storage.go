@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/AndreaCasaluci/go-chat-app/utils"
+)
+
+var (
+	ErrObjectNotFound      = errors.New("object not found")
+	ErrPresignNotSupported = errors.New("storage backend does not support presigned URLs")
+)
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// ObjectStorage is the blob store used for message attachments. Objects are
+// private: they are only ever served after the caller's access was checked.
+type ObjectStorage interface {
+	Put(ctx context.Context, key string, reader io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	// PresignGet returns a URL granting read access to key until expiry
+	// elapses, or ErrPresignNotSupported when objects must be streamed instead.
+	PresignGet(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+var objectStorage ObjectStorage = nil
+
+func newObjectStorage() (ObjectStorage, error) {
+	config, err := utils.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.StorageBackend {
+	case "", "minio":
+		return NewMinioStorage(MinioOptions{
+			Endpoint:       config.MinioEndpoint,
+			PublicEndpoint: config.MinioPublicURL,
+			Region:         config.MinioRegion,
+			AccessKey:      config.MinioAccessKey,
+			SecretKey:      config.MinioSecretKey,
+			Bucket:         config.MinioBucket,
+			UseSSL:         config.MinioUseSSL,
+		})
+	case "local":
+		return NewLocalStorage(config.StorageDir)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", config.StorageBackend)
+	}
+}
+
+func GetStorage() (ObjectStorage, error) {
+	if objectStorage != nil {
+		return objectStorage, nil
+	}
+
+	store, err := newObjectStorage()
+	if err != nil {
+		return nil, err
+	}
+	objectStorage = store
+	return objectStorage, nil
+}
@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIP returns the IP address of the client that sent r. X-Forwarded-For
+// is only honoured when TRUST_PROXY_HEADERS is set, since any client can send
+// it; behind a proxy, the address the proxy appended last is used. X-Real-IP
+// is ignored, as many proxies pass a client supplied one through unchanged.
+func ClientIP(r *http.Request) string {
+	if config, err := GetConfig(); err == nil && config.TrustProxyHeaders {
+		if headers := r.Header.Values("X-Forwarded-For"); len(headers) > 0 {
+			addresses := strings.Split(headers[len(headers)-1], ",")
+			if last := strings.TrimSpace(addresses[len(addresses)-1]); last != "" {
+				return last
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -4,18 +4,57 @@ import (
 	"fmt"
 	"github.com/spf13/viper"
 	"log"
+	"time"
 )
 
 type Config struct {
-	DbHost         string `mapstructure:"DB_HOST"`
-	DbPort         string `mapstructure:"DB_PORT"`
-	ServerPort     string `mapstructure:"SERVER_PORT"`
-	DbUsername     string `mapstructure:"DB_USER"`
-	DbName         string `mapstructure:"DB_NAME"`
-	DbPassword     string `mapstructure:"DB_PASSWORD"`
-	JwtSecretKey   string `mapstructure:"JWT_SECRET_KEY"`
-	MinioAccessKey string `mapstructure:"MINIO_ACCESS_KEY"`
-	MinioSecretKey string `mapstructure:"MINIO_SECRET_KEY"`
+	DbHost                string        `mapstructure:"DB_HOST"`
+	DbPort                string        `mapstructure:"DB_PORT"`
+	ServerPort            string        `mapstructure:"SERVER_PORT"`
+	DbUsername            string        `mapstructure:"DB_USER"`
+	DbName                string        `mapstructure:"DB_NAME"`
+	DbPassword            string        `mapstructure:"DB_PASSWORD"`
+	JwtSecretKey          string        `mapstructure:"JWT_SECRET_KEY"`
+	JwtPrivateKeyFile     string        `mapstructure:"JWT_PRIVATE_KEY_FILE"`
+	JwtPublicKeyFiles     string        `mapstructure:"JWT_PUBLIC_KEY_FILES"`
+	JwtIssuer             string        `mapstructure:"JWT_ISSUER"`
+	JwtAudience           string        `mapstructure:"JWT_AUDIENCE"`
+	JwtLeeway             time.Duration `mapstructure:"JWT_LEEWAY"`
+	AccessTokenTTL        time.Duration `mapstructure:"ACCESS_TOKEN_TTL"`
+	RefreshTokenTTL       time.Duration `mapstructure:"REFRESH_TOKEN_TTL"`
+	MinioAccessKey        string        `mapstructure:"MINIO_ACCESS_KEY"`
+	MinioSecretKey        string        `mapstructure:"MINIO_SECRET_KEY"`
+	MinioEndpoint         string        `mapstructure:"MINIO_ENDPOINT"`
+	MinioPublicURL        string        `mapstructure:"MINIO_PUBLIC_ENDPOINT"`
+	MinioRegion           string        `mapstructure:"MINIO_REGION"`
+	MinioBucket           string        `mapstructure:"MINIO_BUCKET"`
+	MinioUseSSL           bool          `mapstructure:"MINIO_USE_SSL"`
+	StorageBackend        string        `mapstructure:"STORAGE_BACKEND"`
+	StorageDir            string        `mapstructure:"STORAGE_DIR"`
+	MaxUploadMB           int64         `mapstructure:"MAX_UPLOAD_MB"`
+	AllowedOrigins        string        `mapstructure:"ALLOWED_ORIGINS"`
+	TrustProxyHeaders     bool          `mapstructure:"TRUST_PROXY_HEADERS"`
+	AppBaseURL            string        `mapstructure:"APP_BASE_URL"`
+	MailerBackend         string        `mapstructure:"MAILER_BACKEND"`
+	MailLogFile           string        `mapstructure:"MAIL_LOG_FILE"`
+	MailFrom              string        `mapstructure:"MAIL_FROM"`
+	SMTPHost              string        `mapstructure:"SMTP_HOST"`
+	SMTPPort              string        `mapstructure:"SMTP_PORT"`
+	SMTPUsername          string        `mapstructure:"SMTP_USERNAME"`
+	SMTPPassword          string        `mapstructure:"SMTP_PASSWORD"`
+	RateLimitBackend      string        `mapstructure:"RATE_LIMIT_BACKEND"`
+	RateLimitAuth         string        `mapstructure:"RATE_LIMIT_AUTH"`
+	RateLimitWrite        string        `mapstructure:"RATE_LIMIT_WRITE"`
+	RateLimitRead         string        `mapstructure:"RATE_LIMIT_READ"`
+	RateLimitIP           string        `mapstructure:"RATE_LIMIT_IP"`
+	RateLimitWSConnection string        `mapstructure:"RATE_LIMIT_WS_CONNECTION"`
+	RateLimitWSUser       string        `mapstructure:"RATE_LIMIT_WS_USER"`
+	OIDCProviderName      string        `mapstructure:"OIDC_PROVIDER_NAME"`
+	OIDCIssuerURL         string        `mapstructure:"OIDC_ISSUER_URL"`
+	OIDCClientID          string        `mapstructure:"OIDC_CLIENT_ID"`
+	OIDCClientSecret      string        `mapstructure:"OIDC_CLIENT_SECRET"`
+	OIDCRedirectURL       string        `mapstructure:"OIDC_REDIRECT_URL"`
+	OIDCScopes            string        `mapstructure:"OIDC_SCOPES"`
 }
 
 var AppConfig *Config = nil
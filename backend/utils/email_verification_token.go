@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// EmailVerificationClaims prove that whoever holds the token received mail at
+// Email. The subject is the UUID of the user; the token stops working once the
+// user's address is no longer Email.
+type EmailVerificationClaims struct {
+	Type  string `json:"typ"`
+	Email string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+func GenerateEmailVerificationToken(userUUID uuid.UUID, email string, ttl time.Duration) (string, error) {
+	claims := EmailVerificationClaims{
+		Type:             TokenTypeEmailVerification,
+		Email:            email,
+		RegisteredClaims: NewRegisteredClaims(TokenTypeEmailVerification, userUUID.String(), ttl),
+	}
+
+	return SignToken(claims)
+}
+
+func ValidateEmailVerificationToken(tokenString string) (*EmailVerificationClaims, error) {
+	token, err := ParseToken(tokenString, TokenTypeEmailVerification, &EmailVerificationClaims{})
+	if err != nil {
+		return nil, fmt.Errorf("error parsing token: %v", err)
+	}
+
+	claims, ok := token.Claims.(*EmailVerificationClaims)
+	if !ok || !token.Valid || claims.Type != TokenTypeEmailVerification {
+		return nil, fmt.Errorf("invalid or expired token")
+	}
+	return claims, nil
+}
+
+// UserUUID returns the user the token was issued to.
+func (c *EmailVerificationClaims) UserUUID() (uuid.UUID, error) {
+	return uuid.Parse(c.Subject)
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Defaults for the registered claims checked on every token, used when
+// JWT_ISSUER, JWT_AUDIENCE or JWT_LEEWAY are not set.
+const (
+	defaultJwtIssuer   = "go-chat-app"
+	defaultJwtAudience = "go-chat-app"
+	defaultJwtLeeway   = 30 * time.Second
+)
+
+// NewRegisteredClaims returns the registered claims of a new token of
+// tokenType for subject, valid from now for ttl, with a fresh jti, the
+// configured issuer and the audience of tokenType.
+func NewRegisteredClaims(tokenType, subject string, ttl time.Duration) jwt.RegisteredClaims {
+	now := time.Now()
+	issuer, audience, _ := jwtValidationSettings()
+	audience = tokenAudience(audience, tokenType)
+
+	return jwt.RegisteredClaims{
+		ID:        uuid.NewString(),
+		Issuer:    issuer,
+		Subject:   subject,
+		Audience:  jwt.ClaimStrings{audience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+	}
+}
+
+// parserOptions returns the checks applied to every parsed token of
+// tokenType on top of the signature: algorithm, issuer, audience and the time
+// based claims, which allow for leeway of clock skew between servers.
+func parserOptions(ks *KeySet, tokenType string) []jwt.ParserOption {
+	issuer, audience, leeway := jwtValidationSettings()
+	audience = tokenAudience(audience, tokenType)
+
+	return []jwt.ParserOption{
+		jwt.WithValidMethods(ks.validMethods()),
+		jwt.WithIssuer(issuer),
+		jwt.WithAudience(audience),
+		jwt.WithLeeway(leeway),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	}
+}
+
+// tokenAudience returns the aud claim of tokens of tokenType. Only access
+// tokens are issued for the configured audience itself: every other type is
+// signed with the same published keys, so a verifier that checks the audience
+// but not typ must not mistake, say, an mfa_pending token for an access token.
+func tokenAudience(audience, tokenType string) string {
+	if tokenType == TokenTypeAccess {
+		return audience
+	}
+	return audience + ":" + tokenType
+}
+
+// JwtLeeway returns the clock skew allowed when checking the time based
+// claims, which keeps a token usable for that long past its exp.
+func JwtLeeway() time.Duration {
+	_, _, leeway := jwtValidationSettings()
+	return leeway
+}
+
+func jwtValidationSettings() (issuer string, audience string, leeway time.Duration) {
+	issuer, audience, leeway = defaultJwtIssuer, defaultJwtAudience, defaultJwtLeeway
+
+	config, err := GetConfig()
+	if err != nil {
+		return issuer, audience, leeway
+	}
+	if config.JwtIssuer != "" {
+		issuer = config.JwtIssuer
+	}
+	if config.JwtAudience != "" {
+		audience = config.JwtAudience
+	}
+	if config.JwtLeeway > 0 {
+		leeway = config.JwtLeeway
+	}
+	return issuer, audience, leeway
+}
@@ -0,0 +1,360 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Smallest RSA modulus accepted for signing or verification.
+const minRSAKeyBits = 2048
+
+// KeySet holds the key tokens are signed with and every key they are verified
+// against.
+//
+// With JWT_PRIVATE_KEY_FILE set, tokens are signed with that RSA (RS256) or
+// Ed25519 (EdDSA) key, and carry its RFC 7638 thumbprint as kid so that other
+// services can pick the matching key from /.well-known/jwks.json. Public keys
+// listed in JWT_PUBLIC_KEY_FILES are accepted as well, which is how keys are
+// rotated: publish the next key there first, switch the private key once
+// every verifier has fetched it, and drop the old public key once the
+// longest-lived token it signed has expired.
+//
+// Without a private key, tokens are signed with HS256 and JWT_SECRET_KEY. When
+// both are configured, HS256 tokens are still accepted so that a deployment
+// can move to asymmetric keys without logging everyone out.
+type KeySet struct {
+	signing *signingKey
+	keys    map[string]*verificationKey
+	secret  []byte
+}
+
+type signingKey struct {
+	kid    string
+	method jwt.SigningMethod
+	key    interface{}
+}
+
+type verificationKey struct {
+	kid    string
+	method jwt.SigningMethod
+	key    crypto.PublicKey
+}
+
+var (
+	keySet     *KeySet
+	keySetErr  error
+	keySetOnce sync.Once
+)
+
+// GetKeySet loads the key set from the configuration on first use.
+func GetKeySet() (*KeySet, error) {
+	keySetOnce.Do(func() {
+		config, err := GetConfig()
+		if err != nil {
+			keySetErr = err
+			return
+		}
+		keySet, keySetErr = LoadKeySet(config.JwtSecretKey, config.JwtPrivateKeyFile, splitList(config.JwtPublicKeyFiles))
+	})
+	return keySet, keySetErr
+}
+
+// LoadKeySet builds a key set from an HS256 secret, a PEM private key file and
+// PEM public key files, any of which may be empty as long as something can
+// sign tokens.
+func LoadKeySet(secret string, privateKeyFile string, publicKeyFiles []string) (*KeySet, error) {
+	ks := &KeySet{keys: make(map[string]*verificationKey)}
+	if secret != "" {
+		ks.secret = []byte(secret)
+	}
+
+	if privateKeyFile != "" {
+		private, err := readPrivateKey(privateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		public := private.Public()
+
+		vk, err := newVerificationKey(public)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", privateKeyFile, err)
+		}
+		ks.keys[vk.kid] = vk
+		ks.signing = &signingKey{kid: vk.kid, method: vk.method, key: private}
+	} else if ks.secret != nil {
+		ks.signing = &signingKey{method: jwt.SigningMethodHS256, key: ks.secret}
+	} else {
+		return nil, errors.New("neither JWT_PRIVATE_KEY_FILE nor JWT_SECRET_KEY is set")
+	}
+
+	for _, file := range publicKeyFiles {
+		public, err := readPublicKey(file)
+		if err != nil {
+			return nil, err
+		}
+		vk, err := newVerificationKey(public)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		ks.keys[vk.kid] = vk
+	}
+
+	return ks, nil
+}
+
+// Sign signs claims with the current signing key.
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.signing.method, claims)
+	if ks.signing.kid != "" {
+		token.Header["kid"] = ks.signing.kid
+	}
+	return token.SignedString(ks.signing.key)
+}
+
+// Keyfunc resolves the key a token must be verified with from its alg and
+// kid headers. The algorithm is pinned by the key, so a token cannot pick a
+// different algorithm than the one its key is meant for.
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+
+	if alg == jwt.SigningMethodHS256.Alg() {
+		if ks.secret == nil {
+			return nil, fmt.Errorf("unexpected signing method %v", alg)
+		}
+		return ks.secret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if key.method.Alg() != alg {
+		return nil, fmt.Errorf("unexpected signing method %v for key %q", alg, kid)
+	}
+	return key.key, nil
+}
+
+// validMethods lists the algorithms of the configured keys; tokens using any
+// other algorithm are rejected before a key is even looked up.
+func (ks *KeySet) validMethods() []string {
+	var methods []string
+	seen := make(map[string]bool)
+	add := func(alg string) {
+		if !seen[alg] {
+			seen[alg] = true
+			methods = append(methods, alg)
+		}
+	}
+
+	if ks.secret != nil {
+		add(jwt.SigningMethodHS256.Alg())
+	}
+	for _, key := range ks.keys {
+		add(key.method.Alg())
+	}
+	return methods
+}
+
+// JSONWebKey is the public half of a verification key, as published in the
+// JWKS document (RFC 7517).
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JWKS returns every asymmetric verification key, the current signing key
+// first. The HS256 secret is never published.
+func (ks *KeySet) JWKS() JSONWebKeySet {
+	jwks := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range ks.keys {
+		jwk := publicJWK(key.key)
+		jwk.Use = "sig"
+		jwk.Alg = key.method.Alg()
+		jwk.Kid = key.kid
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	sort.Slice(jwks.Keys, func(i, j int) bool {
+		if current := ks.signing.kid; jwks.Keys[i].Kid == current || jwks.Keys[j].Kid == current {
+			return jwks.Keys[i].Kid == current
+		}
+		return jwks.Keys[i].Kid < jwks.Keys[j].Kid
+	})
+	return jwks
+}
+
+// SignToken signs claims with the configured signing key.
+func SignToken(claims jwt.Claims) (string, error) {
+	ks, err := GetKeySet()
+	if err != nil {
+		return "", err
+	}
+	return ks.Sign(claims)
+}
+
+// ParseToken verifies tokenString as a token of tokenType against the
+// configured keys and decodes it into claims.
+func ParseToken(tokenString, tokenType string, claims jwt.Claims) (*jwt.Token, error) {
+	ks, err := GetKeySet()
+	if err != nil {
+		return nil, err
+	}
+	return jwt.ParseWithClaims(tokenString, claims, ks.Keyfunc, parserOptions(ks, tokenType)...)
+}
+
+func newVerificationKey(public crypto.PublicKey) (*verificationKey, error) {
+	var method jwt.SigningMethod
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA key is %d bits, at least %d required", key.N.BitLen(), minRSAKeyBits)
+		}
+		method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, expected RSA or Ed25519", public)
+	}
+
+	return &verificationKey{kid: thumbprint(public), method: method, key: public}, nil
+}
+
+func publicJWK(public crypto.PublicKey) JSONWebKey {
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		return JSONWebKey{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}
+	case ed25519.PublicKey:
+		return JSONWebKey{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(key),
+		}
+	}
+	return JSONWebKey{}
+}
+
+// thumbprint computes the RFC 7638 JWK thumbprint of a public key: the
+// SHA-256 of its required members serialized in lexicographic order.
+func thumbprint(public crypto.PublicKey) string {
+	jwk := publicJWK(public)
+
+	var members map[string]string
+	if jwk.Kty == "RSA" {
+		members = map[string]string{"e": jwk.E, "kty": jwk.Kty, "n": jwk.N}
+	} else {
+		members = map[string]string{"crv": jwk.Crv, "kty": jwk.Kty, "x": jwk.X}
+	}
+
+	// encoding/json sorts map keys and emits no whitespace, as RFC 7638 requires.
+	serialized, _ := json.Marshal(members)
+	sum := sha256.Sum256(serialized)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func readPrivateKey(file string) (crypto.Signer, error) {
+	block, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		return key, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case ed25519.PrivateKey:
+			return key, nil
+		default:
+			return nil, fmt.Errorf("%s: unsupported key type %T, expected RSA or Ed25519", file, key)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unexpected PEM block %q, expected a private key", file, block.Type)
+	}
+}
+
+func readPublicKey(file string) (crypto.PublicKey, error) {
+	block, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		return key, nil
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%s: unexpected PEM block %q, expected a public key", file, block.Type)
+	}
+}
+
+func readPEM(file string) (*pem.Block, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read key file: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", file)
+	}
+	return block, nil
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// MFAPendingClaims are carried by the token handed out when a user with
+// two-factor authentication enabled got their password right. It only grants
+// the right to present a second factor; the subject is the UUID of the user.
+type MFAPendingClaims struct {
+	Type string `json:"typ"`
+	jwt.RegisteredClaims
+}
+
+func GenerateMFAPendingToken(userUUID uuid.UUID, ttl time.Duration) (string, time.Time, error) {
+	claims := MFAPendingClaims{
+		Type:             TokenTypeMFAPending,
+		RegisteredClaims: NewRegisteredClaims(TokenTypeMFAPending, userUUID.String(), ttl),
+	}
+
+	token, err := SignToken(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, claims.ExpiresAt.Time, nil
+}
+
+func ValidateMFAPendingToken(tokenString string) (*MFAPendingClaims, error) {
+	token, err := ParseToken(tokenString, TokenTypeMFAPending, &MFAPendingClaims{})
+	if err != nil {
+		return nil, fmt.Errorf("error parsing token: %v", err)
+	}
+
+	claims, ok := token.Claims.(*MFAPendingClaims)
+	if !ok || !token.Valid || claims.Type != TokenTypeMFAPending {
+		return nil, fmt.Errorf("invalid or expired token")
+	}
+	return claims, nil
+}
+
+// UserUUID returns the user the token was issued to.
+func (c *MFAPendingClaims) UserUUID() (uuid.UUID, error) {
+	return uuid.Parse(c.Subject)
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// OIDCFlowClaims carry the secrets of one OIDC login attempt between the
+// redirect to the issuer and the callback. The token is kept in an HttpOnly
+// cookie so that the callback can only complete in the browser that started
+// the attempt.
+type OIDCFlowClaims struct {
+	Type     string `json:"typ"`
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	jwt.RegisteredClaims
+}
+
+func GenerateOIDCFlowToken(state, nonce, verifier string, ttl time.Duration) (string, error) {
+	claims := OIDCFlowClaims{
+		Type:             TokenTypeOIDCFlow,
+		State:            state,
+		Nonce:            nonce,
+		Verifier:         verifier,
+		RegisteredClaims: NewRegisteredClaims(TokenTypeOIDCFlow, "", ttl),
+	}
+	return SignToken(claims)
+}
+
+func ValidateOIDCFlowToken(tokenString string) (*OIDCFlowClaims, error) {
+	token, err := ParseToken(tokenString, TokenTypeOIDCFlow, &OIDCFlowClaims{})
+	if err != nil {
+		return nil, fmt.Errorf("error parsing token: %v", err)
+	}
+
+	claims, ok := token.Claims.(*OIDCFlowClaims)
+	if !ok || !token.Valid || claims.Type != TokenTypeOIDCFlow {
+		return nil, fmt.Errorf("invalid or expired token")
+	}
+	return claims, nil
+}
@@ -0,0 +1,19 @@
+package utils
+
+import "strings"
+
+// PersonalAccessTokenPrefix starts every personal access token. It tells
+// them apart from JWTs and makes leaked tokens easy to scan for.
+const PersonalAccessTokenPrefix = "gca_pat_"
+
+func GeneratePersonalAccessToken() (string, error) {
+	token, err := GenerateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	return PersonalAccessTokenPrefix + token, nil
+}
+
+func IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, PersonalAccessTokenPrefix)
+}
@@ -2,58 +2,47 @@ package utils
 
 import (
 	"fmt"
-	"github.com/dgrijalva/jwt-go"
+
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 )
 
-var jwtSecret []byte = nil
-
-func retrieveJwtSecret() {
-	if jwtSecret != nil {
-		return
-	}
-
-	config, err := GetConfig()
-	if err != nil {
-		panic(err)
-	}
+// Values of the typ claim, which keeps a token minted for one purpose from
+// being accepted for another.
+const (
+	TokenTypeAccess            = "access"
+	TokenTypeEmailVerification = "email_verification"
+	TokenTypeMFAPending        = "mfa_pending"
+	TokenTypeOIDCFlow          = "oidc_flow"
+)
 
-	jwtSecretString := config.JwtSecretKey
-	if len(jwtSecretString) == 0 {
-		panic("JWT_SECRET_KEY is not set in the environment variables!")
-	}
-	jwtSecret = []byte(jwtSecretString)
+// Claims are the claims of an access token. The same struct is used to sign
+// tokens and to verify them, so the two cannot drift apart.
+type Claims struct {
+	UserID    int64     `json:"user_id"`
+	UserUUID  uuid.UUID `json:"user_uuid"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	SessionID uuid.UUID `json:"sid"`
+	Type      string    `json:"typ"`
+	AuthTime  int64     `json:"auth_time"`
+	jwt.RegisteredClaims
 }
 
-type Claims struct {
-	UserID int64 `json:"user_id"`
-	UserUUID uuid.UUID `json:"user_uuid"`
-	Username string `json:"username"`
-	Email string `json:"email"`
-	jwt.StandardClaims
+// TokenID returns the jti of the token, which identifies it for revocation.
+func (c *Claims) TokenID() (uuid.UUID, error) {
+	return uuid.Parse(c.ID)
 }
 
 func ValidateToken(tokenString string) (*Claims, error) {
-	jwtSecretKey := GetJwtSecret()
-
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecretKey, nil
-	})
+	token, err := ParseToken(tokenString, TokenTypeAccess, &Claims{})
 	if err != nil {
 		return nil, fmt.Errorf("error parsing token: %v", err)
 	}
 
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+	if claims, ok := token.Claims.(*Claims); ok && token.Valid && claims.Type == TokenTypeAccess {
 		return claims, nil
 	}
 
 	return nil, fmt.Errorf("invalid or expired token")
 }
-
-func GetJwtSecret() []byte {
-	if jwtSecret != nil {
-		return jwtSecret
-	}
-	retrieveJwtSecret()
-	return jwtSecret
-}
\ No newline at end of file
@@ -1,6 +1,9 @@
 -- Enable the UUID extension in PostgreSQL
 CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
 
+-- Enable trigram matching, used by the username search
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
 -- Table to store users
 CREATE TABLE IF NOT EXISTS users (
     id SERIAL PRIMARY KEY,                -- Integer primary key
@@ -9,43 +12,213 @@ CREATE TABLE IF NOT EXISTS users (
     password VARCHAR(100) NOT NULL,
     email VARCHAR(255) UNIQUE NOT NULL,    -- Email address
     verified BOOLEAN DEFAULT FALSE,        -- Email verified status (false by default)
+    verification_sent_at TIMESTAMP,       -- Last verification email, used to throttle resends
+    totp_secret TEXT,                      -- Base32 TOTP secret, set on enrollment
+    totp_enabled BOOLEAN NOT NULL DEFAULT FALSE, -- True once enrollment was confirmed with a code
+    totp_last_step BIGINT,                 -- Time step of the last accepted code, to refuse replays
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
     );
 
+-- Trigram index backing prefix and fuzzy username search
+CREATE INDEX IF NOT EXISTS idx_users_username_trgm ON users USING gin (username gin_trgm_ops);
+
 -- Table to store group chats
 CREATE TABLE IF NOT EXISTS group_chats (
     id SERIAL PRIMARY KEY,                                  -- Integer primary key
     uuid UUID DEFAULT uuid_generate_v4() UNIQUE NOT NULL,   -- UUID generated by PostgreSQL
     name VARCHAR(255) NOT NULL,
+    created_by INT NOT NULL,                                -- User who created the group chat
+    announcement_only BOOLEAN NOT NULL DEFAULT FALSE,       -- Only owners and admins can post when true
+    slow_mode_seconds INT NOT NULL DEFAULT 0,               -- Minimum delay between two messages of a member, 0 when off
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (created_by) REFERENCES users(id)
+    );
+
+-- Table to store uploaded media objects referenced by messages
+CREATE TABLE IF NOT EXISTS media (
+    id SERIAL PRIMARY KEY,                                  -- Integer primary key
+    uuid UUID DEFAULT uuid_generate_v4() UNIQUE NOT NULL,   -- UUID generated by PostgreSQL
+    owner_id INT NOT NULL,                                  -- User who uploaded the object
+    object_key TEXT UNIQUE NOT NULL,                        -- Key of the object in the storage bucket
+    media_type VARCHAR(50) NOT NULL,                        -- Media type: "image", "video"
+    content_type VARCHAR(100) NOT NULL,                     -- Sniffed MIME type
+    size_bytes BIGINT NOT NULL,
+    width INT,                                              -- Pixel width of images and videos
+    height INT,                                             -- Pixel height of images and videos
+    thumbnail_key TEXT,                                     -- Key of the generated thumbnail or poster frame
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (owner_id) REFERENCES users(id)
     );
 
 -- Table to store messages
 CREATE TABLE IF NOT EXISTS messages (
-    id SERIAL PRIMARY KEY,                -- Integer primary key
-    uuid UUID DEFAULT uuid_generate_v4(), -- UUID generated by PostgreSQL
+    id SERIAL PRIMARY KEY,                                  -- Integer primary key
+    uuid UUID DEFAULT uuid_generate_v4() UNIQUE NOT NULL,   -- UUID generated by PostgreSQL
     sender_id INT NOT NULL,
     receiver_id INT,
     group_id INT,
     message_text TEXT,                    -- Optional, will be null if media is present
     media_type VARCHAR(50),               -- Media type: "text", "image", "video"
     media_url TEXT,                       -- URL or path to the media file
+    media_id INT,                         -- Uploaded media attached to the message
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (sender_id) REFERENCES users(id),
     FOREIGN KEY (receiver_id) REFERENCES users(id),
-    FOREIGN KEY (group_id) REFERENCES group_chats(id)
+    FOREIGN KEY (media_id) REFERENCES media(id),
+    FOREIGN KEY (group_id) REFERENCES group_chats(id) ON DELETE CASCADE
     );
 
+-- Indexes backing keyset pagination of conversation and group history
+CREATE INDEX IF NOT EXISTS idx_messages_direct ON messages (sender_id, receiver_id, created_at, id) WHERE group_id IS NULL;
+CREATE INDEX IF NOT EXISTS idx_messages_group ON messages (group_id, created_at, id) WHERE group_id IS NOT NULL;
+
+-- Index backing the slow mode check of a member's latest group message
+CREATE INDEX IF NOT EXISTS idx_messages_group_sender ON messages (group_id, sender_id, created_at) WHERE group_id IS NOT NULL;
+
 
 -- Join table to store users in group chats
 CREATE TABLE IF NOT EXISTS group_chat_members (
     group_id INT NOT NULL,
     user_id INT NOT NULL,
+    role VARCHAR(20) NOT NULL DEFAULT 'member',            -- Member role: "owner", "admin", "member"
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     PRIMARY KEY (group_id, user_id),
-    FOREIGN KEY (group_id) REFERENCES group_chats(id),
+    CHECK (role IN ('owner', 'admin', 'member')),
+    FOREIGN KEY (group_id) REFERENCES group_chats(id) ON DELETE CASCADE,
     FOREIGN KEY (user_id) REFERENCES users(id)
     );
+
+CREATE INDEX IF NOT EXISTS idx_group_chat_members_user ON group_chat_members (user_id);
+
+-- Every group has exactly one owner
+CREATE UNIQUE INDEX IF NOT EXISTS idx_group_chat_members_owner ON group_chat_members (group_id) WHERE role = 'owner';
+
+-- Table to store login sessions, one per device. The session UUID is carried
+-- as the sid claim of every access token issued to it.
+CREATE TABLE IF NOT EXISTS sessions (
+    id SERIAL PRIMARY KEY,                                  -- Integer primary key
+    uuid UUID DEFAULT uuid_generate_v4() UNIQUE NOT NULL,   -- UUID generated by PostgreSQL
+    user_id INT NOT NULL,
+    user_agent TEXT,                                        -- User-Agent of the client that logged in
+    ip_address VARCHAR(45),                                 -- Client IP address when last seen
+    expires_at TIMESTAMP NOT NULL,                          -- Expiry of the newest refresh token
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,       -- Updated on every token refresh
+    revoked_at TIMESTAMP,                                   -- Set on logout or remote revocation
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions (user_id) WHERE revoked_at IS NULL;
+
+-- Table to store refresh tokens. Tokens are opaque to clients and stored as
+-- SHA-256 hashes; every token rotated out of the same login shares a family.
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id SERIAL PRIMARY KEY,                -- Integer primary key
+    user_id INT NOT NULL,
+    family_id UUID NOT NULL,              -- Session the token belongs to; shared by all tokens rotated from one login
+    token_hash CHAR(64) UNIQUE NOT NULL,  -- Hex SHA-256 of the token
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,                    -- Set once rotated; presenting it again is reuse
+    revoked_at TIMESTAMP,                 -- Set when the whole family is revoked
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (family_id) REFERENCES sessions(uuid) ON DELETE CASCADE
+    );
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family ON refresh_tokens (family_id);
+
+-- Table to store two-factor recovery codes, as SHA-256 hashes of their
+-- normalized form. Each code can be used once.
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id SERIAL PRIMARY KEY,                -- Integer primary key
+    user_id INT NOT NULL,
+    code_hash CHAR(64) NOT NULL,          -- Hex SHA-256 of the normalized code
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, code_hash),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+
+-- Table to store password reset tokens, as SHA-256 hashes. Each token can be
+-- used once.
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+    id SERIAL PRIMARY KEY,                -- Integer primary key
+    user_id INT NOT NULL,
+    token_hash CHAR(64) UNIQUE NOT NULL,  -- Hex SHA-256 of the token
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,                    -- Set once used, or when a newer reset completes
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+
+CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_user ON password_reset_tokens (user_id, created_at);
+
+-- Table to store revoked access tokens and sessions until they would have
+-- expired anyway
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    token_id UUID PRIMARY KEY,            -- jti of one access token, or sid of a whole session
+    expires_at TIMESTAMP NOT NULL,        -- Once past, no token carrying this id can still be valid
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );
+
+CREATE INDEX IF NOT EXISTS idx_revoked_tokens_expires_at ON revoked_tokens (expires_at);
+
+-- Table to store failed login attempts when the Postgres rate limit backend
+-- is used, shared by every instance of the server
+CREATE TABLE IF NOT EXISTS login_attempts (
+    key TEXT PRIMARY KEY,                 -- What the failures count against, e.g. login:account:<email> or login:ip:<address>
+    failures INT NOT NULL DEFAULT 0,      -- Consecutive failures within the policy window
+    last_failure_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP                -- Attempts are refused until then
+    );
+
+CREATE INDEX IF NOT EXISTS idx_login_attempts_last_failure_at ON login_attempts (last_failure_at);
+
+-- Table to store the external OpenID Connect identities users sign in with
+CREATE TABLE IF NOT EXISTS user_identities (
+    id SERIAL PRIMARY KEY,                -- Integer primary key
+    user_id INT NOT NULL,
+    provider VARCHAR(50) NOT NULL,        -- Name of the configured provider, e.g. "google"
+    subject VARCHAR(255) NOT NULL,        -- sub claim of the issuer, stable for the user
+    email VARCHAR(255),                   -- Email the issuer last reported, for reference only
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_login_at TIMESTAMP,
+    UNIQUE (provider, subject),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+
+CREATE INDEX IF NOT EXISTS idx_user_identities_user ON user_identities (user_id);
+
+-- Table to store personal access tokens minted by users for bots and scripts
+CREATE TABLE IF NOT EXISTS personal_access_tokens (
+    id SERIAL PRIMARY KEY,                                  -- Integer primary key
+    uuid UUID DEFAULT uuid_generate_v4() UNIQUE NOT NULL,   -- UUID generated by PostgreSQL
+    user_id INT NOT NULL,
+    name VARCHAR(100) NOT NULL,                             -- Label chosen by the user
+    token_hash CHAR(64) UNIQUE NOT NULL,                    -- SHA-256 of the token, which is only shown once
+    scopes TEXT[] NOT NULL,                                 -- e.g. {messages:write,groups:read}
+    expires_at TIMESTAMP,                                   -- NULL for tokens that do not expire
+    last_used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    revoked_at TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+
+CREATE INDEX IF NOT EXISTS idx_personal_access_tokens_user ON personal_access_tokens (user_id);
+
+-- Table to store which users blocked which; a block hides both users from
+-- each other's searches and stops direct messages between them
+CREATE TABLE IF NOT EXISTS user_blocks (
+    blocker_id INT NOT NULL,
+    blocked_id INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (blocker_id, blocked_id),
+    CHECK (blocker_id <> blocked_id),
+    FOREIGN KEY (blocker_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (blocked_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+
+CREATE INDEX IF NOT EXISTS idx_user_blocks_blocked ON user_blocks (blocked_id);